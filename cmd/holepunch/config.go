@@ -1,73 +1,68 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"golang.org/x/crypto/ssh"
-	"io/ioutil"
+	"github.com/function61/holepunch-client/pkg/holepunch"
 	"os"
 	"strings"
 )
 
-type SshServer struct {
-	Address            string `json:"address"`
-	Username           string `json:"username"`
-	PrivateKeyFilePath string `json:"private_key_file_path"`
-}
+// first one found is used
+var defaultConfigFiles = []string{"holepunch.json", "holepunch.yaml", "holepunch.yml"}
 
-type Configuration struct {
-	// remote SSH server
-	SshServer SshServer `json:"ssh_server"`
-	Forwards  []Forward `json:"forwards"`
-}
+// from --config. takes precedence over HOLEPUNCH_CONFIG, which takes precedence over defaults
+var configFileFromFlag = ""
 
-type Forward struct {
-	// local service to be forwarded
-	Local Endpoint `json:"local"`
-	// remote forwarding port (on remote SSH server network)
-	Remote Endpoint `json:"remote"`
-}
-
-type Endpoint struct {
-	Host string `json:"host"`
-	Port int    `json:"port"`
-}
+// --migrate-config: rewrite an older config file in the current format before reading it
+var migrateConfigFile = false
 
-func (endpoint *Endpoint) String() string {
-	return fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port)
-}
-
-func readConfig() (*Configuration, error) {
-	confFile, err := os.Open("holepunch.json")
+func readConfig() (*holepunch.Configuration, error) {
+	configFile, err := findConfigFile()
 	if err != nil {
 		return nil, err
 	}
-	defer confFile.Close()
 
-	conf := &Configuration{}
-	jsonDecoder := json.NewDecoder(confFile)
-	jsonDecoder.DisallowUnknownFields()
-	if err := jsonDecoder.Decode(conf); err != nil {
+	if err := migrateConfigFileIfAsked(configFile); err != nil {
 		return nil, err
 	}
 
-	return conf, nil
+	return holepunch.ReadConfigFile(configFile)
 }
 
-func isWebsocketAddress(address string) bool {
-	return strings.HasPrefix(address, "ws://") || strings.HasPrefix(address, "wss://")
-}
+func migrateConfigFileIfAsked(configFile string) error {
+	if !migrateConfigFile {
+		return nil
+	}
 
-func signerFromPrivateKeyFile(file string) (ssh.Signer, error) {
-	buffer, err := ioutil.ReadFile(file)
+	backupFile, err := holepunch.MigrateConfigFile(configFile)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot read SSH public key file %s", file)
+		return fmt.Errorf("migrating %s: %s", configFile, err.Error())
 	}
 
-	key, err := ssh.ParsePrivateKey(buffer)
-	if err != nil {
-		return nil, fmt.Errorf("Cannot parse SSH public key file %s", file)
+	if backupFile != "" {
+		holepunch.NewLogger("migrateConfig").Info(fmt.Sprintf(
+			"migrated %s to the current format; previous one is in %s",
+			configFile,
+			backupFile))
+	}
+
+	return nil
+}
+
+func findConfigFile() (string, error) {
+	if configFileFromFlag != "" {
+		return configFileFromFlag, nil
+	}
+
+	if configFileFromEnv := os.Getenv("HOLEPUNCH_CONFIG"); configFileFromEnv != "" {
+		return configFileFromEnv, nil
+	}
+
+	for _, candidate := range defaultConfigFiles {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
 	}
 
-	return key, nil
+	return "", fmt.Errorf("Config file not found (tried %s)", strings.Join(defaultConfigFiles, ", "))
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/function61/gokit/ossignal"
+	"github.com/function61/holepunch-client/pkg/holepunch"
+	"github.com/spf13/cobra"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+func connectAllEntry() *cobra.Command {
+	return &cobra.Command{
+		Use:   "connect-all [configDir]",
+		Short: "Runs each config file in a directory as an independent tunnel",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := connectAll(args[0]); err != nil {
+				panic(err)
+			}
+		},
+	}
+}
+
+// each tunnel has its own connection and reconnect loop, so one failing (even fatally, like
+// with a config error) doesn't affect the others. returns when all tunnels have stopped
+func connectAll(configDir string) error {
+	log := holepunch.NewLogger("connectAll")
+
+	configFiles, err := configFilesInDir(configDir)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		log.Info(fmt.Sprintf("got %s; stopping all tunnels", ossignal.WaitForInterruptOrTerminate()))
+
+		cancel()
+	}()
+
+	tunnelsRunning := &sync.WaitGroup{}
+
+	failedMu := sync.Mutex{}
+	failed := 0
+
+	for _, configFile := range configFiles {
+		tunnelsRunning.Add(1)
+
+		go func(configFile string) {
+			defer tunnelsRunning.Done()
+
+			log.Info(fmt.Sprintf("starting tunnel %s", configFile))
+
+			if err := runTunnel(ctx, configFile); err != nil {
+				log.Error(fmt.Sprintf("tunnel %s stopped: %s", configFile, err.Error()))
+
+				failedMu.Lock()
+				failed++
+				failedMu.Unlock()
+			}
+		}(configFile)
+	}
+
+	tunnelsRunning.Wait()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tunnel(s) failed", failed, len(configFiles))
+	}
+
+	return nil
+}
+
+func configFilesInDir(configDir string) ([]string, error) {
+	configFiles := []string{}
+
+	for _, pattern := range []string{"*.json", "*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(configDir, pattern))
+		if err != nil {
+			return nil, err
+		}
+
+		configFiles = append(configFiles, matches...)
+	}
+
+	if len(configFiles) == 0 {
+		return nil, fmt.Errorf("No config files (*.json, *.yaml, *.yml) found in %s", configDir)
+	}
+
+	sort.Strings(configFiles)
+
+	return configFiles, nil
+}
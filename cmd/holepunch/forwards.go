@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/function61/holepunch-client/pkg/holepunch"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+func forwardsEntry() *cobra.Command {
+	asJson := false
+
+	cmd := &cobra.Command{
+		Use:   "forwards",
+		Short: "Lists configured forwards",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			conf, err := readConfig()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "config: %s\n", err.Error())
+				os.Exit(1)
+			}
+
+			summaries := []holepunch.ForwardSummary{}
+			for _, forward := range conf.Forwards {
+				summaries = append(summaries, holepunch.SummarizeForward(forward))
+			}
+
+			if asJson {
+				output, err := json.MarshalIndent(summaries, "", "  ")
+				if err != nil {
+					panic(err)
+				}
+
+				fmt.Println(string(output))
+				return
+			}
+
+			printForwardsTable(summaries)
+		},
+	}
+
+	cmd.Flags().BoolVarP(&asJson, "json", "", asJson, "Output as JSON")
+
+	return cmd
+}
+
+func printForwardsTable(summaries []holepunch.ForwardSummary) {
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(table, "DIRECTION\tLOCAL\tREMOTE\tOPTIONS")
+
+	for _, summary := range summaries {
+		options := []string{}
+		for _, key := range sortedKeys(summary.Options) {
+			value := summary.Options[key]
+			if list, isList := value.([]string); isList {
+				value = strings.Join(list, ",")
+			}
+
+			options = append(options, fmt.Sprintf("%s=%v", key, value))
+		}
+
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n",
+			summary.Direction,
+			summary.Local,
+			summary.Remote,
+			strings.Join(options, " "))
+	}
+
+	if err := table.Flush(); err != nil {
+		panic(err)
+	}
+}
+
+func sortedKeys(items map[string]interface{}) []string {
+	keys := []string{}
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"github.com/function61/holepunch-client/pkg/holepunch"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+func generateKeypairEntry() *cobra.Command {
+	force := false
+
+	cmd := &cobra.Command{
+		Use:   "generate-keypair",
+		Short: "Generates ed25519 key pair to private_key_file_path and prints public key",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			conf, err := readConfig()
+			if err != nil {
+				panic(err)
+			}
+
+			if err := holepunch.GenerateKeypairs(conf, force); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+
+			if err := printPubkeys(conf); err != nil {
+				panic(err)
+			}
+		},
+	}
+
+	cmd.Flags().BoolVarP(&force, "force", "", force, "Overwrite existing private key")
+
+	return cmd
+}
+
+func printPubkeys(conf *holepunch.Configuration) error {
+	authorizedKeys, err := holepunch.AuthorizedKeys(conf)
+	if err != nil {
+		return err
+	}
+
+	for _, authorizedKey := range authorizedKeys {
+		fmt.Println(authorizedKey)
+	}
+
+	return nil
+}
+
+func rotateKeyEntry() *cobra.Command {
+	confirm := false
+
+	cmd := &cobra.Command{
+		Use:   "rotate-key",
+		Short: "Replaces private_key_file_path with a new key once the server accepts it (keeps old key as .bak)",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			conf, err := readConfig()
+			if err != nil {
+				panic(err)
+			}
+
+			rotate := holepunch.RotateKey
+			if confirm {
+				rotate = holepunch.ConfirmKeyRotation
+			}
+
+			if err := rotate(conf, os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.Flags().BoolVarP(&confirm, "confirm", "", confirm, "Check that the new key works alone and delete the .bak of the old key")
+
+	return cmd
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const launchdLabel = "com.function61.holepunch"
+
+func writeLaunchdFileEntry() *cobra.Command {
+	system := false
+
+	cmd := &cobra.Command{
+		Use:   "write-launchd-file",
+		Short: "Install launchd plist (macOS) to start this on login (or boot with --system)",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			hints, err := writeLaunchdFile(system)
+			if err != nil {
+				panic(err)
+			}
+
+			fmt.Println(hints)
+		},
+	}
+
+	cmd.Flags().BoolVarP(&system, "system", "", system, "Install to /Library/LaunchDaemons (start on boot) instead of ~/Library/LaunchAgents")
+
+	return cmd
+}
+
+func writeLaunchdFile(system bool) (string, error) {
+	plistDir := "/Library/LaunchDaemons"
+	if !system {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+
+		plistDir = filepath.Join(home, "Library", "LaunchAgents")
+	}
+
+	plistPath := filepath.Join(plistDir, launchdLabel+".plist")
+
+	selfAbsolutePath, err := filepath.Abs(os.Args[0])
+	if err != nil {
+		return "", err
+	}
+
+	serviceArgs, err := serviceConnectArgs()
+	if err != nil {
+		return "", err
+	}
+
+	plist := launchdPlist(
+		append([]string{selfAbsolutePath}, serviceArgs...),
+		filepath.Dir(selfAbsolutePath))
+
+	if _, errStat := os.Stat(plistPath); errStat == nil || !os.IsNotExist(errStat) {
+		return "", errors.New("launchd plist already exists!")
+	}
+
+	if err := os.MkdirAll(plistDir, 0755); err != nil {
+		return "", err
+	}
+
+	if err := ioutil.WriteFile(plistPath, []byte(plist), 0644); err != nil {
+		return "", err
+	}
+
+	hints := []string{
+		"Wrote plist to " + plistPath,
+		"Run to start now (and on every login/boot):",
+		"$ launchctl load -w " + plistPath,
+	}
+
+	return strings.Join(hints, "\n"), nil
+}
+
+// KeepAlive restarts us if we exit
+func launchdPlist(programArguments []string, workingDirectory string) string {
+	escape := func(value string) string {
+		escaped := &strings.Builder{}
+		if err := xml.EscapeText(escaped, []byte(value)); err != nil {
+			panic(err)
+		}
+		return escaped.String()
+	}
+
+	argsXml := ""
+	for _, arg := range programArguments {
+		argsXml += "\t\t<string>" + escape(arg) + "</string>\n"
+	}
+
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>WorkingDirectory</key>
+	<string>%s</string>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+</dict>
+</plist>
+`, launchdLabel, argsXml, escape(workingDirectory))
+}
@@ -3,137 +3,63 @@ package main
 import (
 	"context"
 	"fmt"
-	"github.com/function61/gokit/backoff"
-	"github.com/function61/gokit/bidipipe"
-	"github.com/function61/gokit/logger"
 	"github.com/function61/gokit/ossignal"
-	"github.com/function61/gokit/systemdinstaller"
-	"github.com/function61/holepunch-server/pkg/tcpkeepalive"
-	"github.com/function61/holepunch-server/pkg/wsconnadapter"
-	"github.com/gorilla/websocket"
+	"github.com/function61/holepunch-client/pkg/holepunch"
 	"github.com/spf13/cobra"
-	"golang.org/x/crypto/ssh"
-	"net"
-	"net/http"
-	"net/url"
 	"os"
-	"time"
+	"path/filepath"
 )
 
-var version = "dev" // replaced dynamically at build time
+var version = "dev" // replaced dynamically at build time. see also version.go
 
-func handleClient(client net.Conn, forward Forward) {
-	defer client.Close()
+// connect --once: a single connection attempt, so that restarting is up to whoever runs us
+// (like a supervisor or a CI test)
+var connectOnce = false
 
-	log := logger.New("handleClient")
-	log.Info(fmt.Sprintf("%s connected", client.RemoteAddr()))
-	defer log.Info("closed")
-
-	remote, err := net.Dial("tcp", forward.Local.String())
-	if err != nil {
-		log.Error(fmt.Sprintf("dial INTO local service error: %s", err.Error()))
-		return
-	}
-
-	if err := bidipipe.Pipe(client, "client", remote, "remote"); err != nil {
-		log.Error(err.Error())
-	}
-}
-
-func connectToSshAndServe(ctx context.Context, conf *Configuration, auth ssh.AuthMethod) error {
-	log := logger.New("connectToSshAndServe")
-	log.Info("connecting")
-
-	sshConfig := &ssh.ClientConfig{
-		User:            conf.SshServer.Username,
-		Auth:            []ssh.AuthMethod{auth},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-
-	var sshClient *ssh.Client
-	var errConnect error
-
-	if isWebsocketAddress(conf.SshServer.Address) {
-		sshClient, errConnect = connectSshWebsocket(ctx, conf.SshServer.Address, sshConfig)
-	} else {
-		sshClient, errConnect = connectSshRegularTcp(ctx, conf.SshServer.Address, sshConfig)
-	}
-	if errConnect != nil {
-		return errConnect
-	}
-
-	defer sshClient.Close()
-	defer log.Info("disconnecting")
-
-	log.Info("connected; starting to forward ports")
-
-	listenerStopped := make(chan error, len(conf.Forwards))
-
-	for _, forward := range conf.Forwards {
-		// TODO: errors when Accept() fails later?
-		if err := forwardOnePort(forward, sshClient, listenerStopped); err != nil {
-			// closes SSH connection even if one forward Listen() fails
-			return err
-		}
-	}
-
-	select {
-	case <-ctx.Done():
-		return nil
-	case listenerFirstErr := <-listenerStopped:
-		// assumes all the other listeners failed too so no teardown necessary
-		return listenerFirstErr
+// for "connect" and each tunnel of "connect-all". returns nil when ctx is cancelled
+func runTunnel(ctx context.Context, configFile string) error {
+	if err := migrateConfigFileIfAsked(configFile); err != nil {
+		return err
 	}
-}
-
-//    blocking flow: calls Listen() on the SSH connection, and if succeeds returns non-nil error
-// nonblocking flow: if Accept() call fails, stops goroutine and returns error on ch listenerStopped
-func forwardOnePort(forward Forward, sshClient *ssh.Client, listenerStopped chan<- error) error {
-	log := logger.New("forwardOnePort")
 
-	// Listen on remote server port
-	listener, err := sshClient.Listen("tcp", forward.Remote.String())
+	client, err := holepunch.NewClientFromConfigFile(configFile)
 	if err != nil {
 		return err
 	}
 
-	go func() {
-		defer listener.Close()
-
-		log.Info(fmt.Sprintf("listening remote %s", forward.Remote.String()))
+	client.Once = connectOnce
 
-		// handle incoming connections on reverse forwarded tunnel
-		for {
-			client, err := listener.Accept()
-			if err != nil {
-				listenerStopped <- fmt.Errorf("Accept(): %s", err.Error())
-				return
-			}
+	go reloadConfigOnSighup(ctx, client)
 
-			go handleClient(client, forward)
-		}
-	}()
+	if watchConfigFile {
+		go reloadConfigOnChange(ctx, client, configFile)
+	}
 
-	return nil
+	return client.Run(ctx)
 }
 
 func mainLoop() error {
-	log := logger.New("mainLoop")
+	log := holepunch.NewLogger("mainLoop")
 
-	conf, err := readConfig()
+	configFile, err := findConfigFile()
 	if err != nil {
 		return err
 	}
 
-	privateKey, err := signerFromPrivateKeyFile(conf.SshServer.PrivateKeyFilePath)
-	if err != nil {
-		return err
+	// service manager tells us when to stop instead of signals
+	if runningAsWindowsService() {
+		return runAsWindowsService(func(ctx context.Context) error {
+			return runTunnel(ctx, configFile)
+		})
 	}
 
-	sshAuth := ssh.PublicKeys(privateKey)
-
-	// 0ms, 100 ms, 200 ms, 400 ms, 800 ms, 1600 ms, 2000 ms, 2000 ms...
-	backoffTime := backoff.ExponentialWithCappedMax(100*time.Millisecond, 2*time.Second)
+	// removed on each return, which includes shutdown on SIGTERM (= cancel below)
+	if pidFile != "" {
+		if err := writePidFile(pidFile); err != nil {
+			return err
+		}
+		defer removePidFile(pidFile)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -143,49 +69,98 @@ func mainLoop() error {
 		cancel()
 	}()
 
-	for {
-		err := connectToSshAndServe(ctx, conf, sshAuth)
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
-		}
+	return runTunnel(ctx, configFile)
+}
 
-		log.Error(err.Error())
+// for running "connect" from a service manager
+func serviceConnectArgs() ([]string, error) {
+	serviceArgs := []string{"connect"}
+	if configFileFromFlag != "" { // service's working directory can differ from ours
+		configFileAbs, err := filepath.Abs(configFileFromFlag)
+		if err != nil {
+			return nil, err
+		}
 
-		time.Sleep(backoffTime())
+		serviceArgs = append(serviceArgs, "--config", configFileAbs)
 	}
+
+	return serviceArgs, nil
 }
 
 func main() {
+	logLevel := "info"
+	sshTrace := false
+
 	rootCmd := &cobra.Command{
 		Use:     os.Args[0],
 		Short:   "Self-contained SSH reverse tunnel",
 		Version: version,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if sshTrace {
+				logLevel = "debug"
+			}
+
+			holepunch.SetSshTrace(sshTrace)
+
+			return holepunch.SetLogLevel(logLevel)
+		},
 	}
 
-	rootCmd.AddCommand(&cobra.Command{
+	rootCmd.PersistentFlags().StringVarP(&logLevel, "log-level", "", logLevel, "debug, info, warn or error")
+	rootCmd.PersistentFlags().BoolVarP(&sshTrace, "debug", "", sshTrace, "Trace SSH handshake, authentication and global requests (implies --log-level=debug)")
+	rootCmd.PersistentFlags().StringVarP(&configFileFromFlag, "config", "c", configFileFromFlag, "Config file (default: $HOLEPUNCH_CONFIG or holepunch.json/.yaml/.yml)")
+	rootCmd.PersistentFlags().BoolVarP(&migrateConfigFile, "migrate-config", "", migrateConfigFile, "If the config file is from an older version, rewrite it in the current format (previous one is kept as .bak)")
+
+	connectCmd := &cobra.Command{
 		Use:   "connect",
 		Short: "Connect to remote SSH server to make a persistent reverse tunnel",
 		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
 			if err := mainLoop(); err != nil {
+				if connectOnce { // ending is expected, so no stack trace
+					fmt.Fprintln(os.Stderr, err.Error())
+					os.Exit(1)
+				}
+
 				panic(err)
 			}
 		},
-	})
+	}
+
+	connectCmd.Flags().BoolVarP(&connectOnce, "once", "", connectOnce, "Connect only once: exit (non-zero) when the connection fails or ends instead of reconnecting")
+	connectCmd.Flags().BoolVarP(&watchConfigFile, "watch", "", watchConfigFile, "Reload config when the file changes (like on SIGHUP)")
+	connectCmd.Flags().StringVarP(&pidFile, "pidfile", "", pidFile, "Write process ID to this file (removed on exit)")
+
+	rootCmd.AddCommand(connectCmd)
+
+	rootCmd.AddCommand(connectAllEntry())
+
+	rootCmd.AddCommand(writeSystemdFileEntry())
+
+	rootCmd.AddCommand(writeLaunchdFileEntry())
 
 	rootCmd.AddCommand(&cobra.Command{
-		Use:   "write-systemd-file",
-		Short: "Install unit file to start this on startup",
+		Use:   "write-windows-service",
+		Short: "Install Windows service to start this on startup",
 		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
-			systemdHints, err := systemdinstaller.InstallSystemdServiceFile("holepunch", []string{"connect"}, "Holepunch reverse tunnel")
+			// service's working directory is System32, so config path has to be absolute
+			configFile, err := findConfigFile()
+			if err != nil {
+				panic(err)
+			}
+
+			configFileAbs, err := filepath.Abs(configFile)
 			if err != nil {
 				panic(err)
 			}
 
-			fmt.Println(systemdHints)
+			hints, err := installWindowsService([]string{"connect", "--config", configFileAbs})
+			if err != nil {
+				panic(err)
+			}
+
+			fmt.Println(hints)
 		},
 	})
 
@@ -199,63 +174,32 @@ func main() {
 				panic(err)
 			}
 
-			key, err := signerFromPrivateKeyFile(conf.SshServer.PrivateKeyFilePath)
-			if err != nil {
+			if err := printPubkeys(conf); err != nil {
 				panic(err)
 			}
-
-			fmt.Println(string(ssh.MarshalAuthorizedKey(key.PublicKey())))
 		},
 	})
 
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-}
+	rootCmd.AddCommand(generateKeypairEntry())
 
-func connectSshRegularTcp(ctx context.Context, addr string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
-	dialer := net.Dialer{
-		Timeout:   10 * time.Second,
-		KeepAlive: tcpkeepalive.DefaultDuration,
-	}
+	rootCmd.AddCommand(rotateKeyEntry())
 
-	conn, err := dialer.DialContext(ctx, "tcp", addr)
-	if err != nil {
-		return nil, err
-	}
+	rootCmd.AddCommand(validateConfigEntry())
 
-	return sshClientForConn(conn, addr, sshConfig)
-}
+	rootCmd.AddCommand(printConfigEntry())
 
-// addr looks like "ws://example.com/_ssh"
-func connectSshWebsocket(ctx context.Context, addr string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
-	emptyHeaders := http.Header{}
-	wsConn, _, err := websocket.DefaultDialer.DialContext(ctx, addr, emptyHeaders)
-	if err != nil {
-		return nil, err
-	}
+	rootCmd.AddCommand(forwardsEntry())
 
-	if err := tcpkeepalive.Enable(wsConn.UnderlyingConn().(*net.TCPConn), tcpkeepalive.DefaultDuration); err != nil {
-		return nil, fmt.Errorf("tcpkeepalive: %s", err.Error())
-	}
+	rootCmd.AddCommand(statusEntry())
 
-	// even though we have a solid connection already, for some reason NewClientConn() requires
-	// address. perhaps it's uses for handshake and/or host key verification, so we shouldn't
-	// just give it a dummy value
-	wsUrl, err := url.Parse(addr)
-	if err != nil {
-		return nil, err
-	}
+	rootCmd.AddCommand(testConnectionEntry())
 
-	return sshClientForConn(wsconnadapter.New(wsConn), wsUrl.Hostname(), sshConfig)
-}
+	rootCmd.AddCommand(selfTestEntry())
 
-func sshClientForConn(conn net.Conn, addr string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
-	sconn, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
-	if err != nil {
-		return nil, err
-	}
+	rootCmd.AddCommand(versionEntry())
 
-	return ssh.NewClient(sconn, chans, reqs), nil
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
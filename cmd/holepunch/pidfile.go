@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"github.com/function61/holepunch-client/pkg/holepunch"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// connect --pidfile, for init scripts and "kill $(cat pidfile)"
+var pidFile = ""
+
+func writePidFile(path string) error {
+	if err := ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return fmt.Errorf("Cannot write PID file: %s", err.Error())
+	}
+
+	return nil
+}
+
+// only if it's still ours: another instance may have been started since with the same file
+func removePidFile(path string) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(content)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		holepunch.NewLogger("removePidFile").Error(err.Error())
+	}
+}
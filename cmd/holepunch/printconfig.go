@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/function61/holepunch-client/pkg/holepunch"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+func printConfigEntry() *cobra.Command {
+	return &cobra.Command{
+		Use:   "print-config",
+		Short: "Prints effective configuration (after ENV overrides and defaults), secrets redacted",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			conf, err := readConfig()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "config: %s\n", err.Error())
+				os.Exit(1)
+			}
+
+			asJson, err := json.MarshalIndent(holepunch.RedactSecrets(*conf), "", "  ")
+			if err != nil {
+				panic(err)
+			}
+
+			fmt.Println(string(asJson))
+		},
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"github.com/function61/holepunch-client/pkg/holepunch"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// see Client.Reload() for what is reloaded
+func reloadConfigOnSighup(ctx context.Context, client *holepunch.Client) {
+	log := holepunch.NewLogger("reloadConfig")
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+		}
+
+		if err := client.Reload(); err != nil {
+			log.Error(err.Error())
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"github.com/function61/holepunch-client/pkg/holepunch"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+func selfTestEntry() *cobra.Command {
+	return &cobra.Command{
+		Use:   "selftest",
+		Short: "Loops a reverse forward back to a built-in echo server to test the whole tunnel path",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := selfTest(); err != nil {
+				fmt.Fprintf(os.Stderr, "FAIL: %s\n", err.Error())
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+func selfTest() error {
+	conf, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	return holepunch.SelfTest(conf, os.Stdout)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/function61/holepunch-client/pkg/holepunch"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+func statusEntry() *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Short: "Shows status of a running holepunch (needs control_socket_path)",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := printStatus(); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+func printStatus() error {
+	conf, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	if conf.ControlSocketPath == "" {
+		return errors.New("control_socket_path not set in config")
+	}
+
+	status, err := holepunch.QueryStatus(conf.ControlSocketPath)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("uptime:    %s\n", status.Uptime)
+
+	if status.Connected {
+		fmt.Printf("connected: yes, for %s\n", status.ConnectedFor)
+	} else {
+		fmt.Println("connected: no")
+	}
+
+	for _, forward := range status.Forwards {
+		listening := "not listening"
+		if forward.Listening {
+			listening = "listening on " + forward.ListeningAddr
+		}
+
+		fmt.Printf("%s: %s, %d active connection(s)\n", forward.Forward, listening, forward.ActiveConnections)
+	}
+
+	return nil
+}
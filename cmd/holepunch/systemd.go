@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/function61/gokit/systemdinstaller"
+	"github.com/function61/holepunch-client/pkg/holepunch"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const systemdSocketUnitPath = "/etc/systemd/system/holepunch.socket"
+
+func writeSystemdFileEntry() *cobra.Command {
+	socket := false
+
+	cmd := &cobra.Command{
+		Use:   "write-systemd-file",
+		Short: "Install unit file to start this on startup",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			socketHints := ""
+			if socket {
+				var err error
+				socketHints, err = writeSystemdSocketFile()
+				if err != nil {
+					panic(err)
+				}
+			}
+
+			serviceArgs, err := serviceConnectArgs()
+			if err != nil {
+				panic(err)
+			}
+
+			systemdHints, err := systemdinstaller.InstallSystemdServiceFile("holepunch", serviceArgs, "Holepunch reverse tunnel")
+			if err != nil {
+				panic(err)
+			}
+
+			fmt.Println(systemdHints)
+
+			if socketHints != "" {
+				fmt.Println(socketHints)
+			}
+		},
+	}
+
+	cmd.Flags().BoolVarP(&socket, "socket", "", socket, "Also install holepunch.socket, so that systemd listens on local forwards' addresses (socket activation)")
+
+	return cmd
+}
+
+// for local (and SOCKS) forwards of the config. systemd passes the sockets to the service
+// when starting it, and holepunch matches them to forwards by address
+func writeSystemdSocketFile() (string, error) {
+	conf, err := readConfig()
+	if err != nil {
+		return "", err
+	}
+
+	listenStreams := holepunch.SystemdListenStreams(conf)
+	if len(listenStreams) == 0 {
+		return "", errors.New("No local forwards to listen on (socket activation only applies to local and SOCKS forwards)")
+	}
+
+	unit := []string{
+		"[Unit]",
+		"Description=Holepunch reverse tunnel (local forwards' sockets)",
+		"",
+		"[Socket]",
+	}
+
+	for _, listenStream := range listenStreams {
+		unit = append(unit, "ListenStream="+listenStream)
+	}
+
+	unit = append(unit,
+		"",
+		"[Install]",
+		"WantedBy=sockets.target",
+		"")
+
+	if _, errStat := os.Stat(systemdSocketUnitPath); errStat == nil || !os.IsNotExist(errStat) {
+		return "", errors.New("systemd socket file already exists!")
+	}
+
+	if err := ioutil.WriteFile(systemdSocketUnitPath, []byte(strings.Join(unit, "\n")), 0644); err != nil {
+		return "", err
+	}
+
+	hints := []string{
+		"Wrote socket unit file to " + systemdSocketUnitPath,
+		"Update its ListenStream= lines if you change local forwards. Run to have systemd listen on boot & now:",
+		"$ systemctl enable --now holepunch.socket",
+	}
+
+	return strings.Join(hints, "\n"), nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"github.com/function61/holepunch-client/pkg/holepunch"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+func testConnectionEntry() *cobra.Command {
+	return &cobra.Command{
+		Use:   "test-connection",
+		Short: "Connects to the SSH server, checks that remote ports can be bound, and exits",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := testConnection(); err != nil {
+				fmt.Fprintf(os.Stderr, "FAIL: %s\n", err.Error())
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+func testConnection() error {
+	conf, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	return holepunch.TestConnection(conf, os.Stdout)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"github.com/function61/holepunch-client/pkg/holepunch"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+func validateConfigEntry() *cobra.Command {
+	return &cobra.Command{
+		Use:   "validate-config",
+		Short: "Checks configuration for problems without connecting",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			conf, err := readConfig()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "config: %s\n", err.Error())
+				os.Exit(1)
+			}
+
+			problems := holepunch.ValidateConfig(conf)
+			if len(problems) > 0 {
+				fmt.Fprintf(os.Stderr, "%d problem(s) found:\n", len(problems))
+
+				for _, problem := range problems {
+					fmt.Fprintf(os.Stderr, "- %s\n", problem.Error())
+				}
+
+				os.Exit(1)
+			}
+
+			enabled := len(holepunch.EnabledForwards(conf.Forwards))
+
+			fmt.Printf("OK, %d forward(s) configured (%d disabled)\n", enabled, len(conf.Forwards)-enabled)
+		},
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"runtime"
+	"runtime/debug"
+)
+
+// like version, replaced at build time (-ldflags "-X main.gitCommit=... -X main.buildDate=...").
+// if not, taken from what the Go toolchain embedded (if built from a git checkout)
+var (
+	gitCommit = ""
+	buildDate = ""
+)
+
+type buildMetadata struct {
+	version   string
+	gitCommit string
+	buildDate string
+	goVersion string
+	platform  string
+}
+
+func currentBuildMetadata() buildMetadata {
+	metadata := buildMetadata{
+		version:   version,
+		gitCommit: gitCommit,
+		buildDate: buildDate,
+		goVersion: runtime.Version(),
+		platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		// "go install ...@v1.2.3" records the module version
+		if metadata.version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			metadata.version = info.Main.Version
+		}
+
+		vcs := map[string]string{}
+		for _, setting := range info.Settings {
+			vcs[setting.Key] = setting.Value
+		}
+
+		if metadata.gitCommit == "" && vcs["vcs.revision"] != "" {
+			metadata.gitCommit = vcs["vcs.revision"]
+			if vcs["vcs.modified"] == "true" {
+				metadata.gitCommit += " (with uncommitted changes)"
+			}
+		}
+
+		if metadata.buildDate == "" && vcs["vcs.time"] != "" {
+			metadata.buildDate = vcs["vcs.time"] + " (commit time)"
+		}
+	}
+
+	return metadata
+}
+
+// --version stays the short form
+func versionEntry() *cobra.Command {
+	return &cobra.Command{
+		Use:   "version",
+		Short: "Prints version and build details (for bug reports)",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			metadata := currentBuildMetadata()
+
+			fmt.Printf("holepunch %s\n", metadata.version)
+			fmt.Printf("commit:   %s\n", valueOrUnknown(metadata.gitCommit))
+			fmt.Printf("built:    %s\n", valueOrUnknown(metadata.buildDate))
+			fmt.Printf("go:       %s\n", metadata.goVersion)
+			fmt.Printf("platform: %s\n", metadata.platform)
+		},
+	}
+}
+
+func valueOrUnknown(value string) string {
+	if value == "" {
+		return "(unknown)"
+	}
+
+	return value
+}
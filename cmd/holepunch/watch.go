@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/function61/holepunch-client/pkg/holepunch"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// editors often write a file in several steps (truncate + write, or write temp + rename)
+const configChangeDebounce = 500 * time.Millisecond
+
+// set by "connect --watch"
+var watchConfigFile = false
+
+// alternative to SIGHUP, for when iterating on config. same rules as Client.Reload(): invalid
+// config is not applied, and only forwards are reloaded. files from forwards_include are
+// watched too
+func reloadConfigOnChange(ctx context.Context, client *holepunch.Client, configFile string) {
+	log := holepunch.NewLogger("watchConfig")
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+	defer watcher.Close()
+
+	watched := &watchedConfigFiles{
+		watcher:  watcher,
+		patterns: []string{configFile},
+		dirs:     map[string]bool{},
+	}
+
+	// the config file's directory is a must, the rest we do our best with
+	if err := watched.addDir(filepath.Dir(configFile)); err != nil {
+		log.Error(err.Error())
+		return
+	}
+
+	watched.update(configFile)
+
+	log.Info(fmt.Sprintf("watching %s for changes", configFile))
+
+	var debounce <-chan time.Time // nil = no change pending
+	changedFile := ""             // latest one, for logging
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			if !watched.matches(event.Name) || event.Op == fsnotify.Chmod {
+				continue
+			}
+
+			changedFile = event.Name
+			debounce = time.After(configChangeDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+
+			log.Error(err.Error())
+		case <-debounce:
+			debounce = nil
+
+			log.Info(fmt.Sprintf("%s changed", changedFile))
+
+			if err := client.Reload(); err != nil {
+				log.Error(err.Error())
+			}
+
+			// forwards_include can have changed, or new matching directories appeared
+			watched.update(configFile)
+		}
+	}
+}
+
+// directories are watched instead of files, because a rename replaces the file we'd be
+// watching (and a new file can appear in a forwards_include directory)
+type watchedConfigFiles struct {
+	watcher  *fsnotify.Watcher
+	patterns []string // config file and forwards_include globs
+	dirs     map[string]bool
+}
+
+// keeps the previous patterns if the config can't be read
+func (w *watchedConfigFiles) update(configFile string) {
+	log := holepunch.NewLogger("watchConfig")
+
+	patterns, err := holepunch.ConfigFilePatterns(configFile)
+	if err != nil {
+		log.Error(fmt.Sprintf("not updating watched files: %s", err.Error()))
+		return
+	}
+
+	w.patterns = patterns
+
+	for _, pattern := range patterns {
+		for _, dir := range dirsToWatchFor(pattern) {
+			if err := w.addDir(dir); err != nil {
+				log.Warn(fmt.Sprintf("cannot watch %s: %s", dir, err.Error()))
+			}
+		}
+	}
+}
+
+func (w *watchedConfigFiles) addDir(dir string) error {
+	dir = filepath.Clean(dir)
+	if w.dirs[dir] {
+		return nil
+	}
+
+	if err := w.watcher.Add(dir); err != nil {
+		return err
+	}
+
+	w.dirs[dir] = true
+
+	return nil
+}
+
+func (w *watchedConfigFiles) matches(path string) bool {
+	path = filepath.Clean(path)
+
+	for _, pattern := range w.patterns {
+		if path == filepath.Clean(pattern) {
+			return true
+		}
+
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// with wildcards in the directory part (like "*/forwards.json") only the directories that
+// currently match can be watched
+func dirsToWatchFor(pattern string) []string {
+	dir := filepath.Dir(pattern)
+	if !strings.ContainsAny(dir, "*?[") {
+		return []string{dir}
+	}
+
+	matches, _ := filepath.Glob(dir)
+
+	dirs := []string{}
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.IsDir() {
+			dirs = append(dirs, match)
+		}
+	}
+
+	return dirs
+}
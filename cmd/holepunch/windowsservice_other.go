@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+func installWindowsService(serviceArgs []string) (string, error) {
+	return "", errors.New("Windows services are only supported on Windows")
+}
+
+func runningAsWindowsService() bool {
+	return false
+}
+
+func runAsWindowsService(run func(ctx context.Context) error) error {
+	return errors.New("Windows services are only supported on Windows")
+}
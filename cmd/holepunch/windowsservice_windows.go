@@ -0,0 +1,105 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/function61/holepunch-client/pkg/holepunch"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+	"os"
+)
+
+const windowsServiceName = "holepunch"
+
+func installWindowsService(serviceArgs []string) (string, error) {
+	exePath, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	manager, err := mgr.Connect()
+	if err != nil {
+		return "", fmt.Errorf("connecting to service manager (are you Administrator?): %s", err.Error())
+	}
+	defer manager.Disconnect()
+
+	if existing, err := manager.OpenService(windowsServiceName); err == nil {
+		existing.Close()
+		return "", fmt.Errorf("service %s already exists", windowsServiceName)
+	}
+
+	service, err := manager.CreateService(windowsServiceName, exePath, mgr.Config{
+		DisplayName: "Holepunch reverse tunnel",
+		Description: "Holepunch reverse tunnel",
+		StartType:   mgr.StartAutomatic,
+	}, serviceArgs...)
+	if err != nil {
+		return "", err
+	}
+	defer service.Close()
+
+	return fmt.Sprintf("Wrote service %s\nStart it with:\n  sc start %s", windowsServiceName, windowsServiceName), nil
+}
+
+func runningAsWindowsService() bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		panic(err)
+	}
+
+	return isService
+}
+
+// run's ctx is cancelled when service manager asks us to stop
+func runAsWindowsService(run func(ctx context.Context) error) error {
+	return svc.Run(windowsServiceName, &windowsService{run})
+}
+
+type windowsService struct {
+	run func(ctx context.Context) error
+}
+
+func (w *windowsService) Execute(
+	args []string,
+	requests <-chan svc.ChangeRequest,
+	status chan<- svc.Status,
+) (bool, uint32) {
+	log := holepunch.NewLogger("windowsService")
+
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- w.run(ctx)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-stopped:
+			if err != nil {
+				log.Error(err.Error())
+				return false, 1
+			}
+
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				log.Info("stop requested by service manager")
+
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+			}
+		}
+	}
+}
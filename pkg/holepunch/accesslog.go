@@ -0,0 +1,181 @@
+package holepunch
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// why a connection ended, for access log
+const (
+	closeReasonClosed             = "closed" // either side closed normally
+	closeReasonError              = "error"
+	closeReasonSourceNotAllowed   = "source_not_allowed"
+	closeReasonOverLimit          = "over_limit"
+	closeReasonOverTotalLimit     = "over_total_limit" // max_total_connections
+	closeReasonTlsHandshake       = "tls_handshake_failed"
+	closeReasonDialFailed         = "dial_failed"
+	closeReasonCircuitOpen        = "circuit_open"
+	closeReasonIdleTimeout        = "idle_timeout"
+	closeReasonMaxDurationReached = "max_connection_duration"
+	closeReasonRejectedByHandler  = "rejected_by_handler" // ConnectionHandler returned error
+)
+
+// one JSON line per connection
+type accessLogEntry struct {
+	Time            string  `json:"time"` // when the connection ended
+	Forward         string  `json:"forward"`
+	Client          string  `json:"client"`
+	BytesIn         int64   `json:"bytes_in"`  // from client
+	BytesOut        int64   `json:"bytes_out"` // to client
+	DurationSeconds float64 `json:"duration_seconds"`
+	Reason          string  `json:"reason"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// nil log is usable, and does nothing. separate from operational logs so that it can be kept
+// (and audited) for longer, so it's rotated by size instead of growing unbounded
+type accessLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newAccessLog(conf *Configuration) (*accessLog, error) {
+	if conf.AccessLogPath == "" {
+		return nil, nil
+	}
+
+	a := &accessLog{
+		path:       conf.AccessLogPath,
+		maxSize:    int64(conf.AccessLogMaxSizeMb) * 1024 * 1024,
+		maxBackups: conf.AccessLogMaxBackups,
+	}
+
+	if err := a.open(); err != nil {
+		return nil, fmt.Errorf("access_log_path: %s", err.Error())
+	}
+
+	return a, nil
+}
+
+func (a *accessLog) record(
+	client net.Addr,
+	forward Forward,
+	acceptedAt time.Time,
+	stats *connectionStats,
+	reason string,
+	err error,
+) {
+	if a == nil {
+		return
+	}
+
+	entry := accessLogEntry{
+		Time:            time.Now().UTC().Format(time.RFC3339Nano),
+		Forward:         forward.listenEndpoint().String(),
+		Client:          client.String(),
+		BytesIn:         stats.bytesFromClient,
+		BytesOut:        stats.bytesToClient,
+		DurationSeconds: time.Since(acceptedAt).Seconds(),
+		Reason:          reason,
+	}
+
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	line, errMarshal := json.Marshal(entry)
+	if errMarshal != nil {
+		panic(errMarshal)
+	}
+
+	if errWrite := a.write(append(line, '\n')); errWrite != nil {
+		newLogger("accessLog").Error(fmt.Sprintf("%s: %s", a.path, errWrite.Error()))
+	}
+}
+
+func (a *accessLog) write(line []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+
+	return err
+}
+
+// <path> => <path>.1 => <path>.2 ... up to maxBackups, the oldest of which is overwritten.
+// log is reopened even if renaming fails, so that we keep logging
+func (a *accessLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+
+	errRename := a.renameBackups()
+
+	if err := a.open(); err != nil {
+		return err
+	}
+
+	return errRename
+}
+
+func (a *accessLog) renameBackups() error {
+	if a.maxBackups == 0 {
+		return os.Remove(a.path)
+	}
+
+	for i := a.maxBackups - 1; i >= 1; i-- {
+		older := fmt.Sprintf("%s.%d", a.path, i)
+
+		if err := os.Rename(older, fmt.Sprintf("%s.%d", a.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.Rename(a.path, a.path+".1")
+}
+
+// appends to existing log
+func (a *accessLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	a.file = file
+	a.size = info.Size()
+
+	return nil
+}
+
+func (a *accessLog) close() {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.file.Close()
+}
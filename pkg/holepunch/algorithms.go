@@ -0,0 +1,67 @@
+package holepunch
+
+import (
+	"fmt"
+	"strings"
+)
+
+// what golang.org/x/crypto/ssh implements. the library silently ignores names it doesn't
+// know, so we validate against these to catch typos
+var (
+	supportedCiphers = []string{
+		"aes128-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com",
+		"aes128-ctr",
+		"aes192-ctr",
+		"aes256-ctr",
+		"aes128-cbc",
+		"3des-cbc",
+		"arcfour256",
+		"arcfour128",
+		"arcfour",
+	}
+
+	supportedKeyExchanges = []string{
+		"curve25519-sha256",
+		"curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256",
+		"ecdh-sha2-nistp384",
+		"ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256",
+		"diffie-hellman-group14-sha1",
+		"diffie-hellman-group1-sha1",
+		"diffie-hellman-group-exchange-sha256",
+		"diffie-hellman-group-exchange-sha1",
+	}
+
+	supportedMACs = []string{
+		"hmac-sha2-256-etm@openssh.com",
+		"hmac-sha2-256",
+		"hmac-sha1",
+		"hmac-sha1-96",
+	}
+)
+
+func validateAlgorithms(kind string, wanted []string, supported []string) error {
+	for _, algorithm := range wanted {
+		if !stringInSlice(algorithm, supported) {
+			return fmt.Errorf(
+				"Unsupported %s: %s (supported: %s)",
+				kind,
+				algorithm,
+				strings.Join(supported, ", "))
+		}
+	}
+
+	return nil
+}
+
+func stringInSlice(needle string, haystack []string) bool {
+	for _, item := range haystack {
+		if item == needle {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,308 @@
+package holepunch
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNoAuthConfigured = errors.New("No authentication configured: specify private_key_file_path (or private_key), use_agent and/or keyboard_interactive")
+
+func authMethodsFromConfig(server SshServer) ([]ssh.AuthMethod, error) {
+	signers := []ssh.Signer{}
+
+	if hasPrivateKeys(server) {
+		if err := generateKeyIfMissing(server); err != nil {
+			return nil, err
+		}
+
+		privateKeys, err := privateKeySigners(server)
+		if err != nil {
+			return nil, err
+		}
+
+		signers = append(signers, privateKeys...)
+	}
+
+	var agentClient agent.Agent
+	if server.UseAgent {
+		var err error
+		agentClient, err = connectToAgent()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keyboardInteractive := usesKeyboardInteractive(server)
+
+	if len(signers) == 0 && agentClient == nil {
+		if !keyboardInteractive {
+			return nil, errNoAuthConfigured
+		}
+
+		return []ssh.AuthMethod{ssh.KeyboardInteractive(keyboardInteractiveChallenge(server))}, nil
+	}
+
+	// the SSH library only tries the first AuthMethod of each type, so key file and agent
+	// keys must be offered from the same "publickey" method (key file first)
+	publicKeys := ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		offered := signers
+
+		if agentClient != nil {
+			agentSigners, err := agentClient.Signers()
+			if err != nil {
+				return nil, fmt.Errorf("ssh-agent: %s", err.Error())
+			}
+
+			offered = append(append([]ssh.Signer{}, signers...), agentSigners...)
+		}
+
+		if sshTraceEnabled {
+			return traceSigners(offered), nil
+		}
+
+		return offered, nil
+	})
+
+	if keyboardInteractive {
+		return []ssh.AuthMethod{publicKeys, ssh.KeyboardInteractive(keyboardInteractiveChallenge(server))}, nil
+	}
+
+	return []ssh.AuthMethod{publicKeys}, nil
+}
+
+func hasPrivateKeys(server SshServer) bool {
+	return server.PrivateKey != "" || server.PrivateKeyFilePath != "" || len(server.PrivateKeyFilePaths) > 0
+}
+
+// in the order they're offered to the server: certificate (if any), inline key or key file
+// (inline takes precedence), then PrivateKeyFilePaths
+func privateKeySigners(server SshServer) ([]ssh.Signer, error) {
+	signers := []ssh.Signer{}
+
+	var primaryKey ssh.Signer
+	if server.PrivateKey != "" {
+		key, err := parsePrivateKey([]byte(server.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("Inline SSH private key: %s", err.Error())
+		}
+
+		primaryKey = key
+	} else if server.PrivateKeyFilePath != "" {
+		key, err := loadPrivateKeySigner(server.PrivateKeyFilePath)
+		if err != nil {
+			return nil, err
+		}
+
+		primaryKey = key
+	}
+
+	if server.CertificateFilePath != "" {
+		if primaryKey == nil {
+			return nil, errors.New("certificate_file_path needs private_key_file_path (or private_key)")
+		}
+
+		certSigner, err := loadCertificateSigner(server.CertificateFilePath, primaryKey, server.Username)
+		if err != nil {
+			return nil, err
+		}
+
+		signers = append(signers, certSigner)
+	}
+
+	if primaryKey != nil {
+		signers = append(signers, primaryKey)
+	}
+
+	for _, path := range server.PrivateKeyFilePaths {
+		key, err := loadPrivateKeySigner(path)
+		if err != nil {
+			return nil, err
+		}
+
+		signers = append(signers, key)
+	}
+
+	return signers, nil
+}
+
+// certificate-signed key. expiry and principal problems are only warned about, since the
+// server has the final say (and our clock can be off)
+func loadCertificateSigner(path string, key ssh.Signer, username string) (ssh.Signer, error) {
+	certBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read SSH certificate: %s", err.Error())
+	}
+
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("SSH certificate %s: %s", path, err.Error())
+	}
+
+	cert, isCert := parsed.(*ssh.Certificate)
+	if !isCert {
+		return nil, fmt.Errorf("SSH certificate %s: is a plain public key, not a certificate", path)
+	}
+
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("SSH certificate %s: is a host certificate, not a user certificate", path)
+	}
+
+	// NewCertSigner() checks that the cert is for this key
+	certSigner, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("SSH certificate %s: %s", path, err.Error())
+	}
+
+	for _, problem := range certificateProblems(cert, username, time.Now()) {
+		newLogger("loadCertificate").Warn(fmt.Sprintf("SSH certificate %s: %s", path, problem))
+	}
+
+	return certSigner, nil
+}
+
+func certificateProblems(cert *ssh.Certificate, username string, now time.Time) []string {
+	problems := []string{}
+
+	unixNow := uint64(now.Unix())
+
+	if unixNow < cert.ValidAfter {
+		problems = append(problems, fmt.Sprintf(
+			"not valid until %s",
+			time.Unix(int64(cert.ValidAfter), 0).UTC().Format(time.RFC3339)))
+	}
+
+	if cert.ValidBefore != ssh.CertTimeInfinity && unixNow >= cert.ValidBefore {
+		problems = append(problems, fmt.Sprintf(
+			"expired at %s",
+			time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339)))
+	}
+
+	// no principals = valid for any user
+	if len(cert.ValidPrincipals) > 0 && !stringInSlice(username, cert.ValidPrincipals) {
+		problems = append(problems, fmt.Sprintf(
+			"not valid for user %s (principals: %s)",
+			username,
+			strings.Join(cert.ValidPrincipals, ", ")))
+	}
+
+	return problems
+}
+
+// for private_key_file_path values like "env:HOLEPUNCH_KEY". plain values are file paths.
+// more sources (like secret managers) can be added here
+var privateKeySources = map[string]func(ref string) ([]byte, error){
+	"env": func(name string) ([]byte, error) {
+		value := os.Getenv(name)
+		if value == "" {
+			return nil, fmt.Errorf("ENV variable %s not set", name)
+		}
+
+		return []byte(value), nil
+	},
+}
+
+// "-" = stdin, "<scheme>:<ref>" = from privateKeySources, otherwise a file path
+func loadPrivateKeySigner(source string) (ssh.Signer, error) {
+	var keyBytes []byte
+	var err error
+
+	scheme, ref := privateKeySourceScheme(source)
+
+	switch {
+	case source == "-":
+		keyBytes, err = privateKeyFromStdin()
+	case scheme != "":
+		keyBytes, err = privateKeySources[scheme](ref)
+	default:
+		keyBytes, err = ioutil.ReadFile(source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read SSH private key %s: %s", source, err.Error())
+	}
+
+	key, err := parsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("SSH private key %s: %s", source, err.Error())
+	}
+
+	return key, nil
+}
+
+// only registered schemes count, so a path like "C:\key" isn't mistaken for one
+func privateKeySourceScheme(source string) (string, string) {
+	parts := strings.SplitN(source, ":", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+
+	if _, registered := privateKeySources[parts[0]]; !registered {
+		return "", ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// is a file path that we could write a key to
+func isPrivateKeyFilePath(source string) bool {
+	scheme, _ := privateKeySourceScheme(source)
+
+	return source != "-" && scheme == ""
+}
+
+var stdinPrivateKey struct {
+	once     sync.Once
+	keyBytes []byte
+	err      error
+}
+
+// stdin can be read only once, but the same key can be used for many servers
+func privateKeyFromStdin() ([]byte, error) {
+	stdinPrivateKey.once.Do(func() {
+		stdinPrivateKey.keyBytes, stdinPrivateKey.err = ioutil.ReadAll(os.Stdin)
+	})
+
+	return stdinPrivateKey.keyBytes, stdinPrivateKey.err
+}
+
+// ed25519, ECDSA and RSA keys are supported, in OpenSSH or PEM format. RSA keys are signed
+// with rsa-sha2-256/512 if the server supports it (OpenSSH 8.8+ rejects SHA-1 "ssh-rsa")
+func parsePrivateKey(pemBytes []byte) (ssh.Signer, error) {
+	key, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		if _, encrypted := err.(*ssh.PassphraseMissingError); encrypted {
+			return nil, errors.New("passphrase-protected keys are not supported (use_agent is an alternative)")
+		}
+
+		return nil, fmt.Errorf("cannot parse (supported key types: ed25519, ECDSA, RSA): %s", err.Error())
+	}
+
+	if key.PublicKey().Type() == ssh.KeyAlgoDSA {
+		return nil, errors.New("DSA keys are not supported by modern SSH servers; use ed25519 instead")
+	}
+
+	return key, nil
+}
+
+// the connection is kept open for the lifetime of the process, so the agent is expected to
+// stay running
+func connectToAgent() (agent.Agent, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, errors.New("use_agent specified but SSH_AUTH_SOCK is not set")
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot connect to ssh-agent: %s", err.Error())
+	}
+
+	return agent.NewClient(conn), nil
+}
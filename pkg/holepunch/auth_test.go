@@ -0,0 +1,123 @@
+package holepunch
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"golang.org/x/crypto/ssh"
+	"testing"
+)
+
+func TestParsePrivateKey(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		generate     func(t *testing.T) []byte
+		expectedType string
+	}{
+		{"ed25519 (OpenSSH format)", generateEd25519Pem, ssh.KeyAlgoED25519},
+		{"ECDSA P-256", generateEcdsaP256Pem, ssh.KeyAlgoECDSA256},
+		{"RSA", generateRsaPem, ssh.KeyAlgoRSA},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			signer, err := parsePrivateKey(tc.generate(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if keyType := signer.PublicKey().Type(); keyType != tc.expectedType {
+				t.Errorf("key type %s; expected %s", keyType, tc.expectedType)
+			}
+
+			expectSignatureVerifies(t, signer, "")
+		})
+	}
+}
+
+// OpenSSH 8.8+ rejects SHA-1 signatures, so RSA keys must be able to sign with SHA-2
+func TestParsePrivateKeyRsaSupportsSha2(t *testing.T) {
+	signer, err := parsePrivateKey(generateRsaPem(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, isAlgorithmSigner := signer.(ssh.AlgorithmSigner); !isAlgorithmSigner {
+		t.Fatalf("RSA signer %T is not an ssh.AlgorithmSigner", signer)
+	}
+
+	for _, algorithm := range []string{ssh.SigAlgoRSASHA2256, ssh.SigAlgoRSASHA2512} {
+		expectSignatureVerifies(t, signer, algorithm)
+	}
+}
+
+func TestParsePrivateKeyGarbage(t *testing.T) {
+	if _, err := parsePrivateKey([]byte("not a key")); err == nil {
+		t.Error("expected error")
+	}
+}
+
+// algorithm "" = key type's default
+func expectSignatureVerifies(t *testing.T, signer ssh.Signer, algorithm string) {
+	t.Helper()
+
+	data := []byte("session identifier")
+
+	var signature *ssh.Signature
+	var err error
+	if algorithm == "" {
+		signature, err = signer.Sign(rand.Reader, data)
+	} else {
+		signature, err = signer.(ssh.AlgorithmSigner).SignWithAlgorithm(rand.Reader, data, algorithm)
+	}
+	if err != nil {
+		t.Fatalf("sign %s: %s", algorithm, err.Error())
+	}
+
+	if algorithm != "" && signature.Format != algorithm {
+		t.Errorf("signature format %s; expected %s", signature.Format, algorithm)
+	}
+
+	if err := signer.PublicKey().Verify(data, signature); err != nil {
+		t.Errorf("verify %s: %s", signature.Format, err.Error())
+	}
+}
+
+func generateEd25519Pem(t *testing.T) []byte {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pemBytes, err := marshalEd25519PrivateKey(privateKey, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pemBytes
+}
+
+func generateEcdsaP256Pem(t *testing.T) []byte {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func generateRsaPem(t *testing.T) []byte {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+}
@@ -0,0 +1,131 @@
+package holepunch
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	loadBalanceRoundRobin = "round_robin"
+	loadBalanceRandom     = "random"
+)
+
+// reverse forwards with LocalBackends: Local and LocalBackends, one of which is picked for
+// each dial. shared by copies of the forward
+type backendPool struct {
+	backends []Endpoint
+	policy   string
+	cooldown time.Duration
+
+	mu          sync.Mutex
+	next        int         // for round robin
+	failedUntil []time.Time // zero = healthy
+}
+
+func newBackendPool(forward Forward) *backendPool {
+	return &backendPool{
+		backends:    append([]Endpoint{forward.Local}, forward.LocalBackends...),
+		policy:      forward.LoadBalancePolicy,
+		cooldown:    forward.BackendCooldown.Duration,
+		failedUntil: make([]time.Time, 1+len(forward.LocalBackends)),
+	}
+}
+
+// backends in cooldown are skipped. if all of them are, the one whose cooldown ends first is
+// tried anyway, since failing without trying is no better
+func (b *backendPool) pick() (int, Endpoint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+
+	candidates := []int{}
+	for idx := range b.backends {
+		if !now.Before(b.failedUntil[idx]) {
+			candidates = append(candidates, idx)
+		}
+	}
+
+	if len(candidates) == 0 {
+		soonest := 0
+		for idx := range b.backends {
+			if b.failedUntil[idx].Before(b.failedUntil[soonest]) {
+				soonest = idx
+			}
+		}
+
+		return soonest, b.backends[soonest]
+	}
+
+	var picked int
+	if b.policy == loadBalanceRandom {
+		picked = candidates[rand.Intn(len(candidates))]
+	} else {
+		// first healthy one at or after our turn, so skipping one doesn't double the next one's share
+		picked = candidates[0]
+		for _, idx := range candidates {
+			if idx >= b.next%len(b.backends) {
+				picked = idx
+				break
+			}
+		}
+		b.next = picked + 1
+	}
+
+	return picked, b.backends[picked]
+}
+
+func (b *backendPool) dialFailed(idx int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !time.Now().Before(b.failedUntil[idx]) { // log only once per cooldown
+		newLogger("dialLocal").Warn(fmt.Sprintf(
+			"backend %s: %s; skipping it for %s",
+			b.backends[idx].String(),
+			err.Error(),
+			b.cooldown))
+	}
+
+	b.failedUntil[idx] = time.Now().Add(b.cooldown)
+}
+
+func (b *backendPool) dialSucceeded(idx int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failedUntil[idx] = time.Time{}
+}
+
+func validateLocalBackends(forward Forward) error {
+	if len(forward.LocalBackends) == 0 {
+		if forward.LoadBalancePolicy != "" {
+			return errors.New("load_balance_policy needs local_backends")
+		}
+
+		return nil
+	}
+
+	if forward.Direction != forwardDirectionReverse {
+		return errors.New("local_backends is only supported for reverse forwards")
+	}
+
+	if forward.PortCount > 1 {
+		return errors.New("local_backends cannot be used with port_count")
+	}
+
+	switch forward.LoadBalancePolicy {
+	case loadBalanceRoundRobin, loadBalanceRandom:
+	default:
+		return fmt.Errorf("Invalid load_balance_policy: %s (valid: %s, %s)", forward.LoadBalancePolicy, loadBalanceRoundRobin, loadBalanceRandom)
+	}
+
+	if forward.BackendCooldown.Duration < 0 {
+		return fmt.Errorf("Invalid backend_cooldown: %s", forward.BackendCooldown.String())
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package holepunch
+
+import (
+	"errors"
+	"github.com/function61/gokit/backoff"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// from the beginning. with defaults: 0ms, 100 ms, 200 ms, 400 ms, 800 ms, 1600 ms, 2000 ms...
+func reconnectBackoff(reconnect Reconnect) backoff.Func {
+	backoffTime := backoff.ExponentialWithCappedMax(
+		reconnect.InitialInterval.Duration,
+		reconnect.MaxInterval.Duration)
+	if reconnect.Jitter {
+		backoffTime = withFullJitter(backoffTime)
+	}
+
+	return backoffTime
+}
+
+// for when every server failed resolving its name, which usually means the network isn't up
+// yet (like at boot). hammering at the regular pace would only flood logs: 0s, 1s, 2s, 4s, 8s,
+// 10s, 10s...
+func dnsRetryBackoff() backoff.Func {
+	return backoff.ExponentialWithCappedMax(1*time.Second, 10*time.Second)
+}
+
+// "full jitter": each interval is random between 0 and what the backoff would've been. keeps
+// many clients from reconnecting in lockstep after a shared server comes back
+func withFullJitter(backoffTime backoff.Func) backoff.Func {
+	// own source, because global one might not be seeded and isn't ours to seed
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	return func() time.Duration {
+		max := backoffTime()
+		if max <= 0 {
+			return max
+		}
+
+		return time.Duration(random.Int63n(int64(max) + 1))
+	}
+}
+
+// SSH server's (or proxy's) hostname didn't resolve
+func isNameResolutionError(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
@@ -0,0 +1,57 @@
+package holepunch
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// ".invalid" never resolves (RFC 2606), with or without network
+const unresolvableSshAddress = "nonexistent.invalid:22"
+
+func TestIsNameResolutionError(t *testing.T) {
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy"} {
+		t.Setenv(name, "")
+	}
+
+	server := SshServer{Address: unresolvableSshAddress, ConnectTimeout: Duration{5 * time.Second}}
+
+	t.Run("direct", func(t *testing.T) {
+		_, err := dialSshServer(context.Background(), server, server.Address)
+		expectNameResolutionError(t, err)
+	})
+
+	t.Run("via jump host", func(t *testing.T) {
+		_, _, err := connectSsh(context.Background(), &resolvedSshServer{
+			SshServer: SshServer{Address: "ssh.example.com:22", ConnectTimeout: server.ConnectTimeout},
+			jumpHost:  &resolvedSshServer{SshServer: server},
+		})
+		expectNameResolutionError(t, err)
+	})
+
+	t.Run("via proxy", func(t *testing.T) {
+		proxied := server
+		proxied.ProxyURL = "http://nonexistent.invalid:3128"
+
+		_, err := dialSshServer(context.Background(), proxied, "ssh.example.com:22")
+		expectNameResolutionError(t, err)
+	})
+
+	if isNameResolutionError(&connectError{errors.New("connection refused")}) {
+		t.Error("other errors are not name resolution errors")
+	}
+}
+
+func expectNameResolutionError(t *testing.T, err error) {
+	t.Helper()
+
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	// like runTunnel() sees it
+	if !isNameResolutionError(&connectError{err}) {
+		t.Errorf("not recognized as name resolution error: %s", err.Error())
+	}
+}
@@ -0,0 +1,116 @@
+package holepunch
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const defaultCircuitBreakerCooldown = 30 * time.Second
+
+var errCircuitOpen = errors.New("circuit breaker open: local service is failing")
+
+// reverse forwards with CircuitBreakerThreshold: after that many consecutive failed dials into
+// the local service, connections are rejected without dialing (= circuit open) for the
+// cooldown. then one connection at a time is let through as a probe, and the first successful
+// one closes the circuit. shared by copies of the forward
+type circuitBreaker struct {
+	forward   string // for logs and metrics
+	threshold int
+	cooldown  time.Duration
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+	openUntil           time.Time // zero = closed
+	probing             bool      // after cooldown, a probe is in flight
+}
+
+func newCircuitBreaker(forward Forward) *circuitBreaker {
+	return &circuitBreaker{
+		forward:   forward.listenEndpoint().String(),
+		threshold: forward.CircuitBreakerThreshold,
+		cooldown:  forward.CircuitBreakerCooldown.Duration,
+	}
+}
+
+// false if the connection should be rejected. otherwise call result() after dialing
+func (c *circuitBreaker) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.openUntil.IsZero() {
+		return true
+	}
+
+	if time.Now().Before(c.openUntil) || c.probing {
+		return false
+	}
+
+	c.probing = true
+	return true
+}
+
+func (c *circuitBreaker) result(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	log := newLogger("circuitBreaker")
+
+	wasOpen := !c.openUntil.IsZero()
+	c.probing = false
+
+	if err == nil {
+		c.consecutiveFailures = 0
+
+		if wasOpen {
+			c.openUntil = time.Time{}
+			metrics.circuitOpen.WithLabelValues(c.forward).Set(0)
+
+			log.Info(fmt.Sprintf("%s: local service is back; circuit closed", c.forward))
+		}
+
+		return
+	}
+
+	c.consecutiveFailures++
+
+	if wasOpen || c.consecutiveFailures >= c.threshold {
+		c.openUntil = time.Now().Add(c.cooldown)
+		metrics.circuitOpen.WithLabelValues(c.forward).Set(1)
+
+		if wasOpen {
+			log.Debug(fmt.Sprintf("%s: probe failed; circuit stays open for %s", c.forward, c.cooldown))
+		} else {
+			log.Warn(fmt.Sprintf(
+				"%s: %d consecutive dial failures; circuit open, rejecting connections for %s",
+				c.forward,
+				c.consecutiveFailures,
+				c.cooldown))
+		}
+	}
+}
+
+// dial was cancelled (like the client went away), which tells nothing about the local service
+func (c *circuitBreaker) abandon() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.probing = false
+}
+
+func validateCircuitBreaker(forward Forward) error {
+	if forward.CircuitBreakerThreshold < 0 {
+		return fmt.Errorf("Invalid circuit_breaker_threshold: %d", forward.CircuitBreakerThreshold)
+	}
+
+	if forward.CircuitBreakerThreshold > 0 && forward.Direction != forwardDirectionReverse {
+		return errors.New("circuit_breaker_threshold is only supported for reverse forwards")
+	}
+
+	if forward.CircuitBreakerCooldown.Duration < 0 {
+		return fmt.Errorf("Invalid circuit_breaker_cooldown: %s", forward.CircuitBreakerCooldown.String())
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package holepunch
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Client serves one configuration's forwards over SSH, reconnecting as needed. it's what
+// "holepunch connect" runs, usable for embedding the tunnel in other Go programs
+type Client struct {
+	// return ErrNotReconnecting after the first connection attempt fails or the connection
+	// ends, instead of reconnecting. for when restarting is up to whoever runs us
+	Once bool
+
+	// if set, called for each accepted connection instead of DefaultConnectionHandler.
+	// must be set before Run()
+	ConnectionHandler ConnectionHandler
+
+	conf       *Configuration
+	configFile string // "" if not read from a file, in which case there's nothing to reload
+
+	mu  sync.Mutex
+	tun *tunnel // nil when not running
+}
+
+// conf can come from ReadConfigFile() or be built in code. in the latter case defaults are
+// applied (and conf validated) like for config files, so conf is modified
+func NewClient(conf *Configuration) (*Client, error) {
+	if !conf.prepared {
+		if err := prepareConfig(conf); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Client{conf: conf}, nil
+}
+
+// Reload() re-reads configFile
+func NewClientFromConfigFile(configFile string) (*Client, error) {
+	conf, err := ReadConfigFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		conf:       conf,
+		configFile: configFile,
+	}, nil
+}
+
+// shorthand for NewClient() + Run()
+func Run(ctx context.Context, conf *Configuration) error {
+	client, err := NewClient(conf)
+	if err != nil {
+		return err
+	}
+
+	return client.Run(ctx)
+}
+
+// returns nil when ctx is cancelled. shutdown (waiting for active connections to finish) is
+// done by the time this returns
+func (c *Client) Run(ctx context.Context) error {
+	return runTunnel(ctx, c)
+}
+
+// applies changes to forwards from the config file, like on SIGHUP. other changes need a
+// restart. invalid config is not applied
+func (c *Client) Reload() error {
+	c.mu.Lock()
+	tun := c.tun
+	c.mu.Unlock()
+
+	if tun == nil {
+		return errors.New("reload: not running")
+	}
+
+	return reloadConfig(tun)
+}
+
+func (c *Client) setRunning(tun *tunnel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tun = tun
+}
@@ -0,0 +1,84 @@
+package holepunch
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// DEFLATE-compressed stream. the SSH library doesn't support SSH-level compression, so this
+// is done per forward, which means that the other end of the SSH channel must also be a
+// holepunch forward with compress on (a local forward connecting to a reverse forward's port)
+type compressedConn struct {
+	net.Conn
+	reader    io.ReadCloser
+	writer    *flate.Writer
+	writeMu   sync.Mutex // Close() can come from the other pipe direction
+	closeOnce sync.Once
+	closed    int32 // atomic
+}
+
+// wraps the side of the pipe that is the SSH connection
+func compressSshSide(client net.Conn, remote net.Conn, forward Forward) (net.Conn, net.Conn) {
+	if !forward.Compress {
+		return client, remote
+	}
+
+	if forward.Direction == forwardDirectionReverse {
+		return newCompressedConn(client), remote
+	}
+
+	return client, newCompressedConn(remote)
+}
+
+func newCompressedConn(conn net.Conn) *compressedConn {
+	writer, err := flate.NewWriter(conn, flate.DefaultCompression)
+	if err != nil { // only for invalid level
+		panic(err)
+	}
+
+	return &compressedConn{
+		Conn:   conn,
+		reader: flate.NewReader(conn),
+		writer: writer,
+	}
+}
+
+func (c *compressedConn) Read(b []byte) (int, error) {
+	n, err := c.reader.Read(b)
+	if err != nil && atomic.LoadInt32(&c.closed) == 1 {
+		// after our Close() the stream ends abruptly, which flate reports as an error
+		return n, io.EOF
+	}
+
+	return n, err
+}
+
+// flushes on each write, so that interactive protocols don't stall waiting for more data
+func (c *compressedConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	n, err := c.writer.Write(b)
+	if err != nil {
+		return n, err
+	}
+
+	return n, c.writer.Flush()
+}
+
+// ends the compressed stream properly, so that the other end sees EOF instead of an error
+func (c *compressedConn) Close() error {
+	c.closeOnce.Do(func() {
+		atomic.StoreInt32(&c.closed, 1)
+
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+
+		c.writer.Close()
+	})
+
+	return c.Conn.Close()
+}
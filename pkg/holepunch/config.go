@@ -0,0 +1,923 @@
+package holepunch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/function61/holepunch-server/pkg/tcpkeepalive"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SshServer struct {
+	Address  string `json:"address" yaml:"address"`
+	Username string `json:"username" yaml:"username"`
+	// path, "-" (read from stdin) or "<scheme>:<ref>" like "env:HOLEPUNCH_KEY" (see privateKeySources)
+	PrivateKeyFilePath string `json:"private_key_file_path" yaml:"private_key_file_path"`
+	// generates ed25519 key to PrivateKeyFilePath on connect if the file doesn't exist, and
+	// prints its public key for adding to the server's authorized_keys
+	GenerateKeyIfMissing bool `json:"generate_key_if_missing" yaml:"generate_key_if_missing"`
+	// more keys (same formats as PrivateKeyFilePath) to try, in order. e.g. during key rotation
+	PrivateKeyFilePaths []string `json:"private_key_file_paths" yaml:"private_key_file_paths"`
+	// PEM contents. alternative to PrivateKeyFilePath, and takes precedence over it
+	PrivateKey string `json:"private_key" yaml:"private_key"`
+	// OpenSSH user certificate (like id_ed25519-cert.pub) for the key in PrivateKey or
+	// PrivateKeyFilePath. offered before the plain key
+	CertificateFilePath string `json:"certificate_file_path" yaml:"certificate_file_path"`
+	// authenticate with keys from ssh-agent (SSH_AUTH_SOCK), in addition to PrivateKeyFilePath
+	UseAgent bool `json:"use_agent" yaml:"use_agent"`
+	// keyboard-interactive auth (like password or 2FA prompts), tried after keys. prompts are
+	// answered from KeyboardInteractiveResponses, or asked on the terminal
+	KeyboardInteractive bool `json:"keyboard_interactive" yaml:"keyboard_interactive"`
+	// prompt (like "Password:") => response, for when there's no terminal (like when running as
+	// a service). "env:NAME" reads the response from ENV. setting this enables KeyboardInteractive
+	KeyboardInteractiveResponses map[string]string `json:"keyboard_interactive_responses" yaml:"keyboard_interactive_responses"`
+	// OpenSSH known_hosts format file used for verifying the server's host key
+	KnownHostsFilePath string `json:"known_hosts_file_path" yaml:"known_hosts_file_path"`
+	// records host key to KnownHostsFilePath on first connect if the host is not there yet
+	HostKeyTrustOnFirstUse bool `json:"host_key_trust_on_first_use" yaml:"host_key_trust_on_first_use"`
+	// server's host key in authorized_keys format (like "ssh-ed25519 AAAA..."), as an alternative
+	// to KnownHostsFilePath. connecting fails if the server presents any other key
+	HostPublicKey string `json:"host_public_key" yaml:"host_public_key"`
+	// more accepted host keys (same format as HostPublicKey). e.g. during host key rotation
+	HostPublicKeys []string `json:"host_public_keys" yaml:"host_public_keys"`
+	// DANGEROUS: disables host key verification, leaving you open to MITM attacks
+	InsecureSkipHostKeyVerification bool `json:"insecure_skip_host_key_verification" yaml:"insecure_skip_host_key_verification"`
+	// how often to check that the server is still alive (default 30s)
+	KeepaliveInterval Duration `json:"keepalive_interval" yaml:"keepalive_interval"`
+	// how many unanswered keepalives in a row before reconnecting (default 3)
+	KeepaliveCountMax int `json:"keepalive_count_max" yaml:"keepalive_count_max"`
+	// TCP-level keepalive of the connection to the server (default 15s), for networks that drop
+	// idle connections. "0s" disables. nil until prepareConfig() applies the default
+	TcpKeepaliveInterval *Duration `json:"tcp_keepalive_interval" yaml:"tcp_keepalive_interval"`
+	// for establishing TCP connection (and websocket handshake) (default 10s)
+	ConnectTimeout Duration `json:"connect_timeout" yaml:"connect_timeout"`
+	// additional HTTP headers for websocket connections. values support ${ENV_VAR} expansion
+	WebsocketHeaders map[string]string `json:"websocket_headers" yaml:"websocket_headers"`
+	// file whose contents are sent as "Authorization: Bearer <token>" in websocket handshake.
+	// read on each connect, so a token refreshed by an external agent is picked up
+	WebsocketAuthTokenFile string `json:"websocket_auth_token_file" yaml:"websocket_auth_token_file"`
+	// requested in websocket handshake. connecting fails if server doesn't agree to it
+	WebsocketSubprotocol string `json:"websocket_subprotocol" yaml:"websocket_subprotocol"`
+	// Host header and TLS SNI for websocket connections, if different from the address's host.
+	// like when connecting by IP to a shared ingress that routes by hostname
+	WebsocketHost string `json:"websocket_host" yaml:"websocket_host"`
+	// TLS client certificate for wss:// endpoints requiring mutual TLS
+	ClientCertPath string `json:"client_cert_path" yaml:"client_cert_path"`
+	ClientKeyPath  string `json:"client_key_path" yaml:"client_key_path"`
+	// verify wss:// endpoint's TLS certificate against this CA instead of system CAs
+	CaCertPath string `json:"ca_cert_path" yaml:"ca_cert_path"`
+	// "http://[user:pass@]host:port" (CONNECT) or "socks5://host:port". if not set, proxy is
+	// taken from ENV
+	ProxyURL string `json:"proxy_url" yaml:"proxy_url"`
+	// restrict negotiable algorithms, in order of preference. unset = library defaults
+	Ciphers      []string `json:"ciphers" yaml:"ciphers"`
+	KeyExchanges []string `json:"key_exchanges" yaml:"key_exchanges"`
+	MACs         []string `json:"macs" yaml:"macs"`
+	// like OpenSSH's ProxyJump: connection to this server is tunneled through the jump host,
+	// which has its own address, auth and host key settings
+	JumpHost *SshServer `json:"jump_host" yaml:"jump_host"`
+	// if set, connection is closed (gracefully, like on shutdown) and re-established after it
+	// has been up for this long. for networks that drop long-lived connections
+	MaxConnectionLifetime Duration `json:"max_connection_lifetime" yaml:"max_connection_lifetime"`
+	// cap for concurrently open SSH channels (= forwarded connections) on the connection.
+	// connections over it wait for a channel to free up. 0 = unlimited
+	MaxChannels int `json:"max_channels" yaml:"max_channels"`
+}
+
+type Configuration struct {
+	// shape of this config. older ones are migrated when read (default: current)
+	ConfigVersion int `json:"config_version" yaml:"config_version"`
+	// remote SSH servers. first one is primary, the rest are tried in order if it fails
+	SshServers []SshServer `json:"ssh_servers" yaml:"ssh_servers"`
+	Forwards   []Forward   `json:"forwards" yaml:"forwards"`
+	// files (or globs, like "forwards.d/*.json") with more forwards, as {"forwards": [...]}.
+	// relative to this file's directory
+	ForwardsInclude []string `json:"forwards_include" yaml:"forwards_include"`
+	// on shutdown, how long to wait for active connections to finish (default 10s)
+	ShutdownGracePeriod Duration `json:"shutdown_grace_period" yaml:"shutdown_grace_period"`
+	// if set, Prometheus metrics are served at http://<addr>/metrics
+	MetricsListenAddr string `json:"metrics_listen_addr" yaml:"metrics_listen_addr"`
+	// if set, health check is served at http://<addr>/health (200 = healthy, 503 = not)
+	HealthListenAddr string `json:"health_listen_addr" yaml:"health_listen_addr"`
+	// if set, connection stats are served as expvar at http://<addr>/debug/vars
+	DebugListenAddr string    `json:"debug_listen_addr" yaml:"debug_listen_addr"`
+	Reconnect       Reconnect `json:"reconnect" yaml:"reconnect"`
+	// if set, Unix socket for querying status and triggering reload (see "status" command)
+	ControlSocketPath string        `json:"control_socket_path" yaml:"control_socket_path"`
+	Notifications     Notifications `json:"notifications" yaml:"notifications"`
+	Hooks             Hooks         `json:"hooks" yaml:"hooks"`
+	// if set, a summary of connections and traffic is logged this often while connected
+	StatusLogInterval Duration `json:"status_log_interval" yaml:"status_log_interval"`
+	// if set, one JSON line per forwarded connection is appended here (see accessLogEntry)
+	AccessLogPath string `json:"access_log_path" yaml:"access_log_path"`
+	// access log is rotated when it would grow over this (default 100)
+	AccessLogMaxSizeMb int `json:"access_log_max_size_mb" yaml:"access_log_max_size_mb"`
+	// how many rotated access logs (<path>.1, <path>.2, ...) to keep (default 5)
+	AccessLogMaxBackups int `json:"access_log_max_backups" yaml:"access_log_max_backups"`
+	// connect even if there are no (enabled) forwards, like for testing connectivity. otherwise
+	// that's an error, since it's almost always a config mistake
+	AllowNoForwards bool `json:"allow_no_forwards" yaml:"allow_no_forwards"`
+	// cap for connections across all forwards, over which new connections are rejected, so that
+	// one busy forward can't exhaust file descriptors. 0 = unlimited
+	MaxTotalConnections int `json:"max_total_connections" yaml:"max_total_connections"`
+
+	totalConnectionSlots chan struct{} // semaphore for MaxTotalConnections. nil = unlimited
+	prepared             bool          // by prepareConfig()
+}
+
+// backoff between reconnects grows exponentially from InitialInterval up to MaxInterval
+type Reconnect struct {
+	InitialInterval Duration `json:"initial_interval" yaml:"initial_interval"` // default 100ms
+	MaxInterval     Duration `json:"max_interval" yaml:"max_interval"`         // default 2s
+	// exit (non-zero) after this many connection attempts in a row (across all servers) have
+	// failed. 0 = retry forever
+	MaxAttempts int `json:"max_attempts" yaml:"max_attempts"`
+	// randomize each interval between 0 and its computed value, so that many clients don't
+	// reconnect to the same server in sync
+	Jitter bool `json:"jitter" yaml:"jitter"`
+}
+
+type TlsCertificate struct {
+	CertPath string `json:"cert_path" yaml:"cert_path"`
+	KeyPath  string `json:"key_path" yaml:"key_path"`
+}
+
+type Notifications struct {
+	// if set, event is POSTed here (as JSON) on connect, disconnect and failure to connect
+	WebhookURL string `json:"webhook_url" yaml:"webhook_url"`
+}
+
+// shell commands run when the tunnel comes up (forwards are listening) or goes down. details
+// are passed in ENV (see runHook())
+type Hooks struct {
+	OnConnect    string `json:"on_connect" yaml:"on_connect"`
+	OnDisconnect string `json:"on_disconnect" yaml:"on_disconnect"`
+}
+
+const (
+	overLimitReject = "reject" // close connection immediately
+	overLimitQueue  = "queue"  // wait for a slot to free up
+)
+
+const defaultLocalDialTimeout = 10 * time.Second
+
+const defaultBackendCooldown = 10 * time.Second
+
+const (
+	forwardDirectionReverse = "reverse" // remote listens, connections dialed into local
+	forwardDirectionLocal   = "local"   // local listens, connections dialed into remote
+	forwardDirectionSocks   = "socks"   // local SOCKS5 proxy, connections dialed into remote
+)
+
+type Forward struct {
+	// "reverse" (default), "local" or "socks"
+	Direction string `json:"direction" yaml:"direction"`
+	// local service to be forwarded (reverse) or local listen address (local, socks)
+	Local Endpoint `json:"local" yaml:"local"`
+	// remote forwarding port (reverse) or target on remote SSH server network (local).
+	// not used for socks, as client chooses the target
+	Remote Endpoint `json:"remote" yaml:"remote"`
+	// forward this many consecutive ports, Local.Port+n <=> Remote.Port+n (0 = just the one).
+	// like for passive FTP. limits (like max_concurrent_connections) are shared by the range
+	PortCount int `json:"port_count" yaml:"port_count"`
+	// kept in config (and validated), but not served. for turning a forward off temporarily
+	Disabled bool `json:"disabled" yaml:"disabled"`
+	// if set, only connections from these sources are accepted, like "10.0.0.0/8" or "192.0.2.1".
+	// for reverse forwards the source is the client address as reported by the SSH server
+	AllowedSourceCIDRs []string `json:"allowed_source_cidrs" yaml:"allowed_source_cidrs"`
+	// local and socks forwards: if set, only these destinations can be connected to, like
+	// "*.internal.example.com:443", "db.example.com:5432" or "10.0.0.0/8:22" (port can be
+	// omitted or "*" for any). IPs and CIDRs only match destinations given as IPs
+	AllowedDestinations []string `json:"allowed_destinations" yaml:"allowed_destinations"`
+	// 0 = unlimited
+	MaxConcurrentConnections int `json:"max_concurrent_connections" yaml:"max_concurrent_connections"`
+	// what to do with connections over MaxConcurrentConnections: "reject" (default) or "queue"
+	OverLimitBehavior string `json:"over_limit_behavior" yaml:"over_limit_behavior"`
+	// close connection if no bytes flow in either direction for this long (0 = no timeout)
+	IdleTimeout Duration `json:"idle_timeout" yaml:"idle_timeout"`
+	// close connection after it has been open this long, even if active (0 = no limit). for
+	// clients that would otherwise hold on to connections indefinitely
+	MaxConnectionDuration Duration `json:"max_connection_duration" yaml:"max_connection_duration"`
+	// bandwidth limits shared by all of the forward's connections (0 = unlimited). up = data
+	// sent to the SSH server, down = data received from it
+	MaxBytesPerSecondUp   int `json:"max_bytes_per_second_up" yaml:"max_bytes_per_second_up"`
+	MaxBytesPerSecondDown int `json:"max_bytes_per_second_down" yaml:"max_bytes_per_second_down"`
+	// reverse forwards: how many times to retry (with 100-500ms backoff) if dialing local
+	// service fails, like when it's restarting. 0 = no retries
+	LocalDialRetries int `json:"local_dial_retries" yaml:"local_dial_retries"`
+	// reverse forwards: how long connecting to local service can take (default 10s)
+	LocalDialTimeout Duration `json:"local_dial_timeout" yaml:"local_dial_timeout"`
+	// reverse forwards: more local services (like replicas on other ports) to spread connections
+	// over, in addition to Local. a backend that fails to dial is skipped for BackendCooldown
+	LocalBackends []Endpoint `json:"local_backends" yaml:"local_backends"`
+	// with LocalBackends: "round_robin" (default) or "random"
+	LoadBalancePolicy string `json:"load_balance_policy" yaml:"load_balance_policy"`
+	// with LocalBackends: how long to skip a backend after failing to dial it (default 10s)
+	BackendCooldown Duration `json:"backend_cooldown" yaml:"backend_cooldown"`
+	// reverse forwards: after this many consecutive failures to dial the local service (after
+	// retries), reject connections without dialing for CircuitBreakerCooldown, then let one
+	// through to probe whether it's back. 0 = disabled
+	CircuitBreakerThreshold int `json:"circuit_breaker_threshold" yaml:"circuit_breaker_threshold"`
+	// default 30s
+	CircuitBreakerCooldown Duration `json:"circuit_breaker_cooldown" yaml:"circuit_breaker_cooldown"`
+	// reverse forwards: resolve Local.Host on each connection (instead of letting the dialer
+	// pick the first address) and rotate between its addresses
+	LocalResolveFresh bool `json:"local_resolve_fresh" yaml:"local_resolve_fresh"`
+	// "tcp4" or "tcp6" to use only that IP family for Local, like when Local.Host resolves to
+	// IPv6 first but the service only listens on IPv4. for dialing it (reverse forwards) or
+	// listening on it (local, socks). default "tcp" (either), or "unix" if Local.Socket is set
+	LocalNetwork string `json:"local_network" yaml:"local_network"`
+	// reverse forwards: "v1" or "v2" to send a PROXY protocol header to the local service, so
+	// it sees the real client address
+	SendProxyProtocol string `json:"send_proxy_protocol" yaml:"send_proxy_protocol"`
+	// bytes, for copying data between the ends, in each direction (default 32 KB)
+	PipeBufferSize int `json:"pipe_buffer_size" yaml:"pipe_buffer_size"`
+	// Go disables Nagle's algorithm (= TCP_NODELAY) by default, which is best for latency.
+	// enabling it can improve throughput of bulk transfers with many small writes
+	EnableNagle bool `json:"enable_nagle" yaml:"enable_nagle"`
+	// DSCP (0-63, like 46 for EF) to mark this host's packets of the forwarded TCP connections
+	// with, for QoS-aware networks. 0 (default) leaves marking alone. ignored on Windows
+	DSCP int `json:"dscp" yaml:"dscp"`
+	// if listening fails (like remote port being in use), keep retrying only this forward.
+	// default is to fail the whole connection (and reconnect), so the problem is noticed
+	RetryListen bool `json:"retry_listen" yaml:"retry_listen"`
+	// DEFLATE-compress data inside the SSH channel. only works if the other end is also holepunch
+	// with compress on (a local forward to a reverse forward's port). not for socks
+	Compress bool `json:"compress" yaml:"compress"`
+	// reverse forwards: terminate TLS with this certificate, so that the local service can speak
+	// plain HTTP while the exposed port is HTTPS. TlsCertificates are additional ones, chosen
+	// by SNI (TlsCertPath is the default)
+	TlsCertPath     string           `json:"tls_cert_path" yaml:"tls_cert_path"`
+	TlsKeyPath      string           `json:"tls_key_path" yaml:"tls_key_path"`
+	TlsCertificates []TlsCertificate `json:"tls_certificates" yaml:"tls_certificates"`
+
+	allowedSourceNets   []*net.IPNet         // parsed from AllowedSourceCIDRs by prepareConfig()
+	allowedDestinations []destinationPattern // parsed from AllowedDestinations by prepareConfig()
+	connectionSlots     chan struct{}        // semaphore for MaxConcurrentConnections. shared by copies
+	totalSlots          chan struct{}        // Configuration.totalConnectionSlots. shared by all forwards
+	upLimiter           *rate.Limiter        // for MaxBytesPerSecondUp. nil = unlimited
+	downLimiter         *rate.Limiter        // for MaxBytesPerSecondDown. nil = unlimited
+	resolveCounter      *uint64              // for LocalResolveFresh round robin. shared by copies
+	backends            *backendPool         // nil if no LocalBackends
+	circuitBreaker      *circuitBreaker      // nil if no CircuitBreakerThreshold
+	tlsCertificates     *certificateStore    // for TLS termination. nil = not terminating
+}
+
+// no allowlist means all sources are allowed. if there is one, a source whose IP we can't
+// determine (like a Unix socket peer) is rejected
+func (forward *Forward) sourceAllowed(source net.Addr) bool {
+	if len(forward.allowedSourceNets) == 0 {
+		return true
+	}
+
+	var sourceIp net.IP
+	if tcpAddr, is := source.(*net.TCPAddr); is {
+		sourceIp = tcpAddr.IP
+	} else if host, _, err := net.SplitHostPort(source.String()); err == nil {
+		sourceIp = net.ParseIP(host)
+	}
+
+	if sourceIp == nil {
+		return false
+	}
+
+	for _, allowedNet := range forward.allowedSourceNets {
+		if allowedNet.Contains(sourceIp) {
+			return true
+		}
+	}
+
+	return false
+}
+
+var errNoForwards = errors.New("No forwards configured (or all are disabled); set allow_no_forwards to connect anyway")
+
+func validateLocalNetwork(forward Forward) error {
+	switch forward.LocalNetwork {
+	case "":
+		return nil
+	case "unix":
+		if !forward.Local.isUnixSocket() {
+			return errors.New("local_network unix needs local.socket")
+		}
+	case "tcp", "tcp4", "tcp6":
+		if forward.Local.isUnixSocket() {
+			return fmt.Errorf("local_network %s cannot be used with local.socket", forward.LocalNetwork)
+		}
+	default:
+		return fmt.Errorf("Invalid local_network: %s (valid: tcp, tcp4, tcp6, unix)", forward.LocalNetwork)
+	}
+
+	return nil
+}
+
+// network for dialing or listening on Local
+func (forward *Forward) localNetwork() string {
+	return forward.localNetworkFor(forward.Local)
+}
+
+// endpoint is Local or one of LocalBackends, which can mix TCP and Unix sockets
+func (forward *Forward) localNetworkFor(endpoint Endpoint) string {
+	if forward.LocalNetwork != "" && endpoint.network() == "tcp" {
+		return forward.LocalNetwork
+	}
+
+	return endpoint.network()
+}
+
+func validatePortCount(forward Forward) error {
+	switch {
+	case forward.PortCount < 0:
+		return fmt.Errorf("Invalid port_count: %d", forward.PortCount)
+	case forward.PortCount <= 1:
+		return nil
+	case forward.Direction == forwardDirectionSocks:
+		return errors.New("port_count is not supported for socks forwards")
+	case forward.Local.isUnixSocket() || forward.Remote.isUnixSocket():
+		return errors.New("port_count cannot be used with Unix sockets")
+	case forward.Local.Port == 0 || forward.Remote.Port == 0:
+		return errors.New("port_count needs explicit local and remote ports")
+	case forward.Local.Port+forward.PortCount-1 > 65535 || forward.Remote.Port+forward.PortCount-1 > 65535:
+		return fmt.Errorf("port_count %d: range goes over port 65535", forward.PortCount)
+	}
+
+	return nil
+}
+
+// port_count forwards become one forward per port, each served (and shown in health,
+// metrics etc.) like any other
+func expandPortRanges(forwards []Forward) []Forward {
+	expanded := []Forward{}
+
+	for _, forward := range forwards {
+		if forward.PortCount <= 1 {
+			expanded = append(expanded, forward)
+			continue
+		}
+
+		for n := 0; n < forward.PortCount; n++ {
+			onePort := forward
+			onePort.PortCount = 0
+			onePort.Local.Port += n
+			onePort.Remote.Port += n
+
+			expanded = append(expanded, onePort)
+		}
+	}
+
+	return expanded
+}
+
+// without the ones with Disabled
+func EnabledForwards(forwards []Forward) []Forward {
+	enabled := []Forward{}
+
+	for _, forward := range forwards {
+		if !forward.Disabled {
+			enabled = append(enabled, forward)
+		}
+	}
+
+	return enabled
+}
+
+// the side we Listen() on, which identifies the forward
+func (forward *Forward) listenEndpoint() *Endpoint {
+	if forward.Direction == forwardDirectionReverse {
+		return &forward.Remote
+	}
+
+	return &forward.Local
+}
+
+type Endpoint struct {
+	Host string `json:"host" yaml:"host"`
+	Port int    `json:"port" yaml:"port"`
+	// Unix domain socket path. if set, Host and Port are not used
+	Socket string `json:"socket" yaml:"socket"`
+}
+
+func (endpoint *Endpoint) isUnixSocket() bool {
+	return endpoint.Socket != ""
+}
+
+// for net.Dial(), net.Listen() and their SSH equivalents
+func (endpoint *Endpoint) network() string {
+	if endpoint.isUnixSocket() {
+		return "unix"
+	}
+
+	return "tcp"
+}
+
+func (endpoint *Endpoint) address() string {
+	if endpoint.isUnixSocket() {
+		return endpoint.Socket
+	}
+
+	// brackets IPv6 literals, like [::1]:8080
+	return net.JoinHostPort(endpoint.Host, strconv.Itoa(endpoint.Port))
+}
+
+func (endpoint *Endpoint) String() string {
+	if endpoint.isUnixSocket() {
+		return "unix:" + endpoint.Socket
+	}
+
+	return endpoint.address()
+}
+
+// in JSON/YAML a string understood by time.ParseDuration(), like "30s" or "1m30s"
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+
+	return d.parse(str)
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var str string
+	if err := value.Decode(&str); err != nil {
+		return err
+	}
+
+	return d.parse(str)
+}
+
+func (d *Duration) parse(str string) error {
+	duration, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = duration
+	return nil
+}
+
+// format is chosen by file extension. defaults are applied and the config validated, like
+// oddities that are easy to check without connecting
+func ReadConfigFile(path string) (*Configuration, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	yamlFormat := isYamlConfigFile(path)
+
+	// older configs are migrated in memory, and the file only with MigrateConfigFile()
+	migrated, changes, err := migrateConfig(content, yamlFormat)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	if migrated != nil {
+		log := newLogger("ReadConfigFile")
+
+		for _, change := range changes {
+			log.Warn(fmt.Sprintf("%s: %s", path, change))
+		}
+
+		log.Warn(fmt.Sprintf(
+			"%s: migrated to config_version %d in memory; use --migrate-config to update the file",
+			path,
+			currentConfigVersion))
+
+		content = migrated
+	}
+
+	conf := &Configuration{}
+
+	if err := decodeStrict(content, yamlFormat, conf); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	forwardSources, err := includeForwards(conf, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(conf.SshServers) == 0 {
+		return nil, errors.New("No SSH servers configured")
+	}
+
+	if err := expandEnvInConfig(conf); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	// after expansion, since two forwards can differ only by their ${VAR}s
+	if err := checkDuplicateRemotes(conf.Forwards, forwardSources); err != nil {
+		return nil, err
+	}
+
+	applyEnvOverrides(conf)
+
+	if err := prepareConfig(conf); err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+func isYamlConfigFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return true
+	default:
+		return false
+	}
+}
+
+// unknown fields are errors, so that typos don't go unnoticed
+func decodeStrict(content []byte, yamlFormat bool, into interface{}) error {
+	if yamlFormat {
+		yamlDecoder := yaml.NewDecoder(bytes.NewReader(content))
+		yamlDecoder.KnownFields(true)
+		return yamlDecoder.Decode(into)
+	}
+
+	jsonDecoder := json.NewDecoder(bytes.NewReader(content))
+	jsonDecoder.DisallowUnknownFields()
+	return jsonDecoder.Decode(into)
+}
+
+// applies defaults and parses things (like CIDRs) needed at runtime. only once per
+// Configuration, since parsed things are appended to
+func prepareConfig(conf *Configuration) error {
+	if len(conf.SshServers) == 0 {
+		return errors.New("No SSH servers configured")
+	}
+
+	for i := range conf.SshServers {
+		if err := applySshServerDefaults(&conf.SshServers[i]); err != nil {
+			return err
+		}
+	}
+
+	switch conf.ConfigVersion {
+	case 0:
+		conf.ConfigVersion = currentConfigVersion
+	case currentConfigVersion:
+	default: // ReadConfigFile() migrates older ones
+		return fmt.Errorf("Unsupported config_version %d (expected %d)", conf.ConfigVersion, currentConfigVersion)
+	}
+
+	if conf.ShutdownGracePeriod.Duration == 0 {
+		conf.ShutdownGracePeriod.Duration = 10 * time.Second
+	}
+
+	if conf.AccessLogMaxSizeMb == 0 {
+		conf.AccessLogMaxSizeMb = 100
+	}
+
+	if conf.AccessLogMaxBackups == 0 {
+		conf.AccessLogMaxBackups = 5
+	}
+
+	if conf.AccessLogMaxSizeMb < 0 || conf.AccessLogMaxBackups < 0 {
+		return errors.New("access_log_max_size_mb and access_log_max_backups cannot be negative")
+	}
+
+	if conf.Reconnect.InitialInterval.Duration == 0 {
+		conf.Reconnect.InitialInterval.Duration = 100 * time.Millisecond
+	}
+
+	if conf.Reconnect.MaxInterval.Duration == 0 {
+		conf.Reconnect.MaxInterval.Duration = 2 * time.Second
+	}
+
+	if conf.MaxTotalConnections < 0 {
+		return fmt.Errorf("Invalid max_total_connections: %d", conf.MaxTotalConnections)
+	}
+
+	if conf.MaxTotalConnections > 0 {
+		conf.totalConnectionSlots = make(chan struct{}, conf.MaxTotalConnections)
+	}
+
+	for i, forward := range conf.Forwards {
+		conf.Forwards[i].totalSlots = conf.totalConnectionSlots
+
+		switch forward.Direction {
+		case "":
+			conf.Forwards[i].Direction = forwardDirectionReverse
+		case forwardDirectionReverse, forwardDirectionLocal, forwardDirectionSocks:
+		default:
+			return fmt.Errorf("Unknown forward direction: %s", forward.Direction)
+		}
+
+		for _, cidr := range forward.AllowedSourceCIDRs {
+			allowedNet, err := parseCidrOrIp(cidr)
+			if err != nil {
+				return err
+			}
+
+			conf.Forwards[i].allowedSourceNets = append(conf.Forwards[i].allowedSourceNets, allowedNet)
+		}
+
+		if len(forward.AllowedDestinations) > 0 && conf.Forwards[i].Direction == forwardDirectionReverse {
+			return errors.New("allowed_destinations is only supported for local and socks forwards")
+		}
+
+		for _, destination := range forward.AllowedDestinations {
+			pattern, err := parseDestinationPattern(destination)
+			if err != nil {
+				return err
+			}
+
+			conf.Forwards[i].allowedDestinations = append(conf.Forwards[i].allowedDestinations, pattern)
+		}
+
+		switch forward.OverLimitBehavior {
+		case "":
+			conf.Forwards[i].OverLimitBehavior = overLimitReject
+		case overLimitReject, overLimitQueue:
+		default:
+			return fmt.Errorf("Unknown over_limit_behavior: %s", forward.OverLimitBehavior)
+		}
+
+		if forward.MaxConcurrentConnections < 0 {
+			return fmt.Errorf("Invalid max_concurrent_connections: %d", forward.MaxConcurrentConnections)
+		}
+
+		if forward.MaxConcurrentConnections > 0 {
+			conf.Forwards[i].connectionSlots = make(chan struct{}, forward.MaxConcurrentConnections)
+		}
+
+		if forward.MaxBytesPerSecondUp < 0 || forward.MaxBytesPerSecondDown < 0 {
+			return errors.New("Invalid max_bytes_per_second_up/down: must not be negative")
+		}
+
+		conf.Forwards[i].upLimiter = newBandwidthLimiter(forward.MaxBytesPerSecondUp)
+		conf.Forwards[i].downLimiter = newBandwidthLimiter(forward.MaxBytesPerSecondDown)
+
+		conf.Forwards[i].resolveCounter = new(uint64)
+
+		if forward.LocalDialTimeout.Duration == 0 {
+			conf.Forwards[i].LocalDialTimeout.Duration = defaultLocalDialTimeout
+		}
+
+		if err := validateLocalNetwork(forward); err != nil {
+			return err
+		}
+
+		if conf.Forwards[i].Direction != forwardDirectionReverse { // needs Direction default
+			if err := validateLocalBindAddress(forward.Local); err != nil {
+				return fmt.Errorf("local: %s", err.Error())
+			}
+		}
+
+		if err := validatePortCount(conf.Forwards[i]); err != nil { // needs Direction default
+			return err
+		}
+
+		if len(forward.LocalBackends) > 0 {
+			if forward.LoadBalancePolicy == "" {
+				conf.Forwards[i].LoadBalancePolicy = loadBalanceRoundRobin
+			}
+
+			if forward.BackendCooldown.Duration == 0 {
+				conf.Forwards[i].BackendCooldown.Duration = defaultBackendCooldown
+			}
+		}
+
+		if err := validateLocalBackends(conf.Forwards[i]); err != nil { // needs Direction default
+			return err
+		}
+
+		if len(forward.LocalBackends) > 0 {
+			conf.Forwards[i].backends = newBackendPool(conf.Forwards[i])
+		}
+
+		if forward.CircuitBreakerCooldown.Duration == 0 {
+			conf.Forwards[i].CircuitBreakerCooldown.Duration = defaultCircuitBreakerCooldown
+		}
+
+		if err := validateCircuitBreaker(conf.Forwards[i]); err != nil { // needs Direction default
+			return err
+		}
+
+		if forward.CircuitBreakerThreshold > 0 {
+			conf.Forwards[i].circuitBreaker = newCircuitBreaker(conf.Forwards[i])
+		}
+
+		if forward.LocalDialRetries < 0 {
+			return fmt.Errorf("Invalid local_dial_retries: %d", forward.LocalDialRetries)
+		}
+
+		switch {
+		case forward.PipeBufferSize == 0:
+			conf.Forwards[i].PipeBufferSize = defaultPipeBufferSize
+		case forward.PipeBufferSize < 0:
+			return fmt.Errorf("Invalid pipe_buffer_size: %d", forward.PipeBufferSize)
+		}
+
+		if forward.DSCP < 0 || forward.DSCP > 63 {
+			return fmt.Errorf("Invalid dscp: %d (must be 0-63)", forward.DSCP)
+		}
+
+		if forward.Compress && conf.Forwards[i].Direction == forwardDirectionSocks {
+			return errors.New("compress is not supported for socks forwards")
+		}
+
+		if err := setupTlsTermination(&conf.Forwards[i]); err != nil {
+			return err
+		}
+
+		switch forward.SendProxyProtocol {
+		case "":
+		case proxyProtocolV1, proxyProtocolV2:
+			if conf.Forwards[i].Direction != forwardDirectionReverse {
+				return errors.New("send_proxy_protocol is only supported for reverse forwards")
+			}
+		default:
+			return fmt.Errorf("Unknown send_proxy_protocol: %s", forward.SendProxyProtocol)
+		}
+	}
+
+	conf.prepared = true
+
+	return nil
+}
+
+func setupTlsTermination(forward *Forward) error {
+	if forward.TlsCertPath == "" && forward.TlsKeyPath == "" && len(forward.TlsCertificates) == 0 {
+		return nil
+	}
+
+	if forward.Direction != forwardDirectionReverse {
+		return errors.New("TLS termination is only supported for reverse forwards")
+	}
+
+	if forward.TlsCertPath == "" || forward.TlsKeyPath == "" {
+		return errors.New("TLS termination needs both tls_cert_path and tls_key_path")
+	}
+
+	if forward.Compress {
+		return errors.New("compress can't be used with TLS termination")
+	}
+
+	pairs := append([]TlsCertificate{{forward.TlsCertPath, forward.TlsKeyPath}}, forward.TlsCertificates...)
+
+	store, err := newCertificateStore(pairs)
+	if err != nil {
+		return err
+	}
+
+	forward.tlsCertificates = store
+
+	return nil
+}
+
+// also for the server's jump host, if any
+func applySshServerDefaults(server *SshServer) error {
+	if server.KeepaliveInterval.Duration == 0 {
+		server.KeepaliveInterval.Duration = 30 * time.Second
+	}
+
+	if server.KeepaliveCountMax == 0 {
+		server.KeepaliveCountMax = 3
+	}
+
+	// pointer, because zero is meaningful
+	if server.TcpKeepaliveInterval == nil {
+		server.TcpKeepaliveInterval = &Duration{tcpkeepalive.DefaultDuration}
+	}
+
+	if server.TcpKeepaliveInterval.Duration < 0 {
+		return fmt.Errorf("Invalid tcp_keepalive_interval: %s", server.TcpKeepaliveInterval.String())
+	}
+
+	if server.ConnectTimeout.Duration == 0 {
+		server.ConnectTimeout.Duration = 10 * time.Second
+	}
+
+	if server.MaxChannels < 0 {
+		return fmt.Errorf("Invalid max_channels: %d", server.MaxChannels)
+	}
+
+	if err := validateAlgorithms("cipher", server.Ciphers, supportedCiphers); err != nil {
+		return err
+	}
+
+	if err := validateAlgorithms("key exchange", server.KeyExchanges, supportedKeyExchanges); err != nil {
+		return err
+	}
+
+	if err := validateAlgorithms("MAC", server.MACs, supportedMACs); err != nil {
+		return err
+	}
+
+	if server.WebsocketHost != "" && !isWebsocketAddress(server.Address) {
+		return errors.New("websocket_host needs a ws:// or wss:// address")
+	}
+
+	if server.WebsocketAuthTokenFile != "" {
+		if !isWebsocketAddress(server.Address) {
+			return errors.New("websocket_auth_token_file needs a ws:// or wss:// address")
+		}
+
+		for key := range server.WebsocketHeaders {
+			if http.CanonicalHeaderKey(key) == "Authorization" {
+				return errors.New("websocket_auth_token_file and websocket_headers Authorization cannot both be set")
+			}
+		}
+	}
+
+	if pinned := pinnedHostKeyLines(*server); len(pinned) > 0 {
+		if server.KnownHostsFilePath != "" || server.HostKeyTrustOnFirstUse || server.InsecureSkipHostKeyVerification {
+			return errors.New("host_public_key(s) cannot be combined with known_hosts_file_path, host_key_trust_on_first_use or insecure_skip_host_key_verification")
+		}
+
+		if _, err := parsePinnedHostKeys(pinned); err != nil {
+			return err
+		}
+	}
+
+	if server.JumpHost != nil {
+		if isWebsocketAddress(server.Address) || isTlsAddress(server.Address) {
+			return errors.New("jump_host is not supported for WebSocket or TLS addresses")
+		}
+
+		if err := applySshServerDefaults(server.JumpHost); err != nil {
+			return fmt.Errorf("jump_host: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// ENV takes precedence over values from config file. applies to the primary server
+func applyEnvOverrides(conf *Configuration) {
+	primary := &conf.SshServers[0]
+
+	overrides := []struct {
+		envName string
+		target  *string
+	}{
+		{"HOLEPUNCH_SSH_ADDRESS", &primary.Address},
+		{"HOLEPUNCH_SSH_USERNAME", &primary.Username},
+		{"HOLEPUNCH_SSH_PRIVATE_KEY_PATH", &primary.PrivateKeyFilePath},
+		{"HOLEPUNCH_SSH_PRIVATE_KEY", &primary.PrivateKey},
+	}
+
+	// inline key from the file would otherwise win over the path from ENV
+	if os.Getenv("HOLEPUNCH_SSH_PRIVATE_KEY_PATH") != "" {
+		primary.PrivateKey = ""
+	}
+
+	for _, override := range overrides {
+		if value := os.Getenv(override.envName); value != "" {
+			*override.target = value
+		}
+	}
+}
+
+// plain IP is treated as a single-host network
+func parseCidrOrIp(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid IP address in allowed_source_cidrs: %s", cidr)
+		}
+
+		if ipv4 := ip.To4(); ipv4 != nil {
+			return &net.IPNet{IP: ipv4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CIDR in allowed_source_cidrs: %s", cidr)
+	}
+
+	return ipNet, nil
+}
+
+func isWebsocketAddress(address string) bool {
+	return strings.HasPrefix(address, "ws://") || strings.HasPrefix(address, "wss://")
+}
@@ -0,0 +1,246 @@
+package holepunch
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const equivalentJsonConfig = `{
+	"ssh_servers": [
+		{
+			"address": "ssh.example.com:22",
+			"username": "tunnel",
+			"private_key_file_path": "/etc/holepunch/id_ed25519",
+			"known_hosts_file_path": "/etc/holepunch/known_hosts",
+			"keepalive_interval": "15s",
+			"connect_timeout": "5s",
+			"jump_host": {
+				"address": "bastion.example.com:2222",
+				"username": "jump",
+				"private_key_file_path": "/etc/holepunch/jump_key",
+				"known_hosts_file_path": "/etc/holepunch/known_hosts",
+				"keepalive_interval": "1m"
+			}
+		}
+	],
+	"forwards": [
+		{
+			"local": { "host": "127.0.0.1", "port": 8080 },
+			"remote": { "host": "0.0.0.0", "port": 80 },
+			"idle_timeout": "15m",
+			"max_connection_duration": "24h"
+		}
+	],
+	"shutdown_grace_period": "30s",
+	"reconnect": { "initial_interval": "500ms", "max_interval": "1m30s", "max_attempts": 5 }
+}`
+
+const equivalentYamlConfig = `
+ssh_servers:
+  - address: ssh.example.com:22
+    username: tunnel
+    private_key_file_path: /etc/holepunch/id_ed25519
+    known_hosts_file_path: /etc/holepunch/known_hosts
+    keepalive_interval: 15s
+    connect_timeout: 5s
+    jump_host:
+      address: bastion.example.com:2222
+      username: jump
+      private_key_file_path: /etc/holepunch/jump_key
+      known_hosts_file_path: /etc/holepunch/known_hosts
+      keepalive_interval: 1m
+forwards:
+  - local: { host: 127.0.0.1, port: 8080 }
+    remote: { host: 0.0.0.0, port: 80 }
+    idle_timeout: 15m
+    max_connection_duration: 24h
+shutdown_grace_period: 30s
+reconnect:
+  initial_interval: 500ms
+  max_interval: 1m30s
+  max_attempts: 5
+`
+
+func TestJsonAndYamlConfigsAreEquivalent(t *testing.T) {
+	fromJson := readTestConfig(t, "holepunch.json", equivalentJsonConfig)
+	fromYaml := readTestConfig(t, "holepunch.yaml", equivalentYamlConfig)
+
+	if !reflect.DeepEqual(fromJson, fromYaml) {
+		t.Fatalf("JSON and YAML configs differ\nJSON: %s\nYAML: %s", jsonKey(fromJson), jsonKey(fromYaml))
+	}
+
+	// guard against both formats failing the same way (like durations not being parsed at all)
+	server := fromYaml.SshServers[0]
+
+	expectDuration(t, "keepalive_interval", server.KeepaliveInterval, 15*time.Second)
+	expectDuration(t, "connect_timeout", server.ConnectTimeout, 5*time.Second)
+	expectDuration(t, "shutdown_grace_period", fromYaml.ShutdownGracePeriod, 30*time.Second)
+	expectDuration(t, "reconnect.max_interval", fromYaml.Reconnect.MaxInterval, 90*time.Second)
+	expectDuration(t, "idle_timeout", fromYaml.Forwards[0].IdleTimeout, 15*time.Minute)
+
+	if server.JumpHost == nil {
+		t.Fatal("jump_host not parsed")
+	}
+
+	if server.JumpHost.Address != "bastion.example.com:2222" {
+		t.Errorf("jump_host.address = %s", server.JumpHost.Address)
+	}
+
+	expectDuration(t, "jump_host.keepalive_interval", server.JumpHost.KeepaliveInterval, time.Minute)
+}
+
+func TestUnknownFieldsAreErrors(t *testing.T) {
+	for _, file := range []struct {
+		name    string
+		content string
+	}{
+		{"holepunch.json", `{"ssh_servers": [{"address": "a:22", "usrname": "typo"}]}`},
+		{"holepunch.yaml", "ssh_servers:\n  - address: a:22\n    usrname: typo\n"},
+	} {
+		if _, err := ReadConfigFile(writeTestFile(t, file.name, file.content)); err == nil {
+			t.Errorf("%s: expected error for unknown field", file.name)
+		}
+	}
+}
+
+func readTestConfig(t *testing.T, name string, content string) *Configuration {
+	t.Helper()
+
+	conf, err := ReadConfigFile(writeTestFile(t, name, content))
+	if err != nil {
+		t.Fatalf("%s: %s", name, err.Error())
+	}
+
+	return conf
+}
+
+func writeTestFile(t *testing.T, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func expectDuration(t *testing.T, field string, actual Duration, expected time.Duration) {
+	t.Helper()
+
+	if actual.Duration != expected {
+		t.Errorf("%s = %s; expected %s", field, actual.Duration, expected)
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	const fileConfig = `{
+		"ssh_servers": [
+			{ "address": "file.example.com:22", "username": "file", "private_key": "inline key from file" },
+			{ "address": "secondary.example.com:22", "username": "secondary" }
+		],
+		"forwards": [{ "local": { "port": 8080 }, "remote": { "port": 80 } }]
+	}`
+
+	for _, tc := range []struct {
+		name     string
+		env      map[string]string
+		expected SshServer
+	}{
+		{
+			name:     "no overrides",
+			expected: SshServer{Address: "file.example.com:22", Username: "file", PrivateKey: "inline key from file"},
+		},
+		{
+			name: "address and username",
+			env: map[string]string{
+				"HOLEPUNCH_SSH_ADDRESS":  "env.example.com:22",
+				"HOLEPUNCH_SSH_USERNAME": "env",
+			},
+			expected: SshServer{Address: "env.example.com:22", Username: "env", PrivateKey: "inline key from file"},
+		},
+		{
+			name:     "key path replaces inline key from file",
+			env:      map[string]string{"HOLEPUNCH_SSH_PRIVATE_KEY_PATH": "/env/id_ed25519"},
+			expected: SshServer{Address: "file.example.com:22", Username: "file", PrivateKeyFilePath: "/env/id_ed25519"},
+		},
+		{
+			name: "inline key from ENV wins over key path from ENV",
+			env: map[string]string{
+				"HOLEPUNCH_SSH_PRIVATE_KEY_PATH": "/env/id_ed25519",
+				"HOLEPUNCH_SSH_PRIVATE_KEY":      "inline key from env",
+			},
+			expected: SshServer{Address: "file.example.com:22", Username: "file", PrivateKeyFilePath: "/env/id_ed25519", PrivateKey: "inline key from env"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, name := range []string{"HOLEPUNCH_SSH_ADDRESS", "HOLEPUNCH_SSH_USERNAME", "HOLEPUNCH_SSH_PRIVATE_KEY_PATH", "HOLEPUNCH_SSH_PRIVATE_KEY"} {
+				t.Setenv(name, tc.env[name])
+			}
+
+			conf := readTestConfig(t, "holepunch.json", fileConfig)
+
+			primary := conf.SshServers[0]
+			actual := SshServer{
+				Address:            primary.Address,
+				Username:           primary.Username,
+				PrivateKeyFilePath: primary.PrivateKeyFilePath,
+				PrivateKey:         primary.PrivateKey,
+			}
+
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("got %+v; expected %+v", actual, tc.expected)
+			}
+
+			if secondary := conf.SshServers[1]; secondary.Address != "secondary.example.com:22" || secondary.Username != "secondary" {
+				t.Errorf("overrides should only apply to the primary server; got %+v", secondary)
+			}
+		})
+	}
+}
+
+// configs from before ssh_servers had a single ssh_server
+func TestSingleSshServerConfigStillLoads(t *testing.T) {
+	conf := readTestConfig(t, "holepunch.json", `{
+		"ssh_server": { "address": "ssh.example.com:22", "username": "tunnel", "private_key_file_path": "id_ecdsa" },
+		"forwards": [{ "local": { "host": "127.0.0.1", "port": 8080 }, "remote": { "host": "0.0.0.0", "port": 8080 } }]
+	}`)
+
+	if len(conf.SshServers) != 1 || conf.SshServers[0].Address != "ssh.example.com:22" || conf.SshServers[0].Username != "tunnel" {
+		t.Fatalf("ssh_server not migrated into ssh_servers: %+v", conf.SshServers)
+	}
+
+	if _, err := ReadConfigFile(writeTestFile(t, "holepunch.json", `{
+		"ssh_server": { "address": "a:22" },
+		"ssh_servers": [{ "address": "b:22" }]
+	}`)); err == nil {
+		t.Error("expected error for both ssh_server and ssh_servers")
+	}
+}
+
+func TestEndpointAddress(t *testing.T) {
+	for _, tc := range []struct {
+		endpoint        Endpoint
+		expectedAddress string
+		expectedString  string
+	}{
+		{Endpoint{Host: "127.0.0.1", Port: 8080}, "127.0.0.1:8080", "127.0.0.1:8080"},
+		{Endpoint{Host: "2001:db8::1", Port: 22}, "[2001:db8::1]:22", "[2001:db8::1]:22"},
+		{Endpoint{Host: "::1", Port: 8080}, "[::1]:8080", "[::1]:8080"},
+		{Endpoint{Host: "example.com", Port: 80}, "example.com:80", "example.com:80"},
+		{Endpoint{Port: 80}, ":80", ":80"},
+		{Endpoint{Socket: "/run/app.sock"}, "/run/app.sock", "unix:/run/app.sock"},
+	} {
+		if address := tc.endpoint.address(); address != tc.expectedAddress {
+			t.Errorf("%+v address() = %s; expected %s", tc.endpoint, address, tc.expectedAddress)
+		}
+
+		if str := tc.endpoint.String(); str != tc.expectedString {
+			t.Errorf("%+v String() = %s; expected %s", tc.endpoint, str, tc.expectedString)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package holepunch
+
+import (
+	"context"
+	"net"
+)
+
+// ConnectionHandler is called for each accepted connection of forward, after our own checks
+// (allowed_source_cidrs, connection limits, TLS termination). calling dialAndPipe() does what
+// holepunch would do without a handler: dials the target and pipes conn to it until either
+// side closes. the handler can inspect conn, wrap it (pass the wrapper to dialAndPipe()), or
+// reject it by returning without calling dialAndPipe(). conn is closed after the handler returns.
+// ctx is cancelled (and conn closed) when the SSH connection is torn down
+type ConnectionHandler func(
+	ctx context.Context,
+	conn net.Conn,
+	forward Forward,
+	dialAndPipe func(conn net.Conn) error,
+) error
+
+// the behaviour when Client.ConnectionHandler is not set
+func DefaultConnectionHandler(
+	ctx context.Context,
+	conn net.Conn,
+	forward Forward,
+	dialAndPipe func(conn net.Conn) error,
+) error {
+	return dialAndPipe(conn)
+}
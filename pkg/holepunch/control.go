@@ -0,0 +1,157 @@
+package holepunch
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// control protocol: client sends one command line, we respond and close the connection.
+// commands:
+//   status  JSON-encoded ControlStatus
+//   reload  "OK" or "error: ..."
+
+type ControlStatus struct {
+	Uptime       string         `json:"uptime"`
+	Connected    bool           `json:"connected"`
+	ConnectedFor string         `json:"connected_for"`
+	Forwards     []ForwardState `json:"forwards"`
+}
+
+func serveControl(ctx context.Context, socketPath string, tun *tunnel) {
+	log := newLogger("serveControl")
+
+	// stale socket from previous run would prevent listening
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		log.Error(err.Error())
+		return
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+	defer os.Remove(socketPath)
+
+	// anyone who can connect can reload config
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		log.Error(err.Error())
+		return
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	log.Info(fmt.Sprintf("listening on %s", socketPath))
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+			default:
+				log.Error(err.Error())
+			}
+			return
+		}
+
+		go handleControlConn(conn, tun)
+	}
+}
+
+func handleControlConn(conn net.Conn, tun *tunnel) {
+	defer conn.Close()
+
+	log := newLogger("handleControlConn")
+
+	if err := conn.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		log.Error(err.Error())
+		return
+	}
+
+	command, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		log.Error(fmt.Sprintf("reading command: %s", err.Error()))
+		return
+	}
+
+	var response string
+
+	switch strings.TrimSpace(command) {
+	case "status":
+		uptime, connectedFor := tun.state.uptimes()
+		status := tun.state.snapshot()
+
+		asJson, err := json.Marshal(ControlStatus{
+			Uptime:       uptime.Round(time.Second).String(),
+			Connected:    status.Connected,
+			ConnectedFor: connectedFor.Round(time.Second).String(),
+			Forwards:     status.Forwards,
+		})
+		if err != nil {
+			log.Error(err.Error())
+			return
+		}
+
+		response = string(asJson)
+	case "reload":
+		log.Info("reload requested")
+
+		if err := reloadConfig(tun); err != nil {
+			log.Error(err.Error())
+			response = "error: " + err.Error()
+		} else {
+			response = "OK"
+		}
+	default:
+		response = fmt.Sprintf("error: unknown command '%s'", strings.TrimSpace(command))
+	}
+
+	if _, err := conn.Write([]byte(response + "\n")); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// status of a running holepunch, over its control socket
+func QueryStatus(socketPath string) (*ControlStatus, error) {
+	response, err := controlCommand(socketPath, "status")
+	if err != nil {
+		return nil, err
+	}
+
+	status := &ControlStatus{}
+	if err := json.Unmarshal([]byte(response), status); err != nil {
+		return nil, fmt.Errorf("unexpected response: %s", response)
+	}
+
+	return status, nil
+}
+
+func controlCommand(socketPath string, command string) (string, error) {
+	conn, err := net.DialTimeout("unix", socketPath, 5*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("is holepunch running? %s", err.Error())
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		return "", err
+	}
+
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(response)), nil
+}
@@ -0,0 +1,104 @@
+package holepunch
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// tunnels published as expvar "holepunch", by config name. expvar names are process-wide
+// while connect-all runs many tunnels in one process, so there's one var for all of them
+var debugVars = &debugVarsRegistry{
+	tunnels: map[string]*tunnelState{},
+}
+
+type debugVarsRegistry struct {
+	mu          sync.Mutex
+	tunnels     map[string]*tunnelState
+	publishOnce sync.Once
+}
+
+type debugVarsTunnel struct {
+	Connected         bool                            `json:"connected"`
+	Reconnects        int                             `json:"reconnects"`
+	ActiveConnections int                             `json:"active_connections"`
+	TotalConnections  int                             `json:"total_connections"`
+	BytesTransferred  int64                           `json:"bytes_transferred"`
+	Forwards          map[string]debugVarsForwardStat `json:"forwards"`
+}
+
+type debugVarsForwardStat struct {
+	ActiveConnections int   `json:"active_connections"`
+	TotalConnections  int   `json:"total_connections"`
+	BytesTransferred  int64 `json:"bytes_transferred"`
+}
+
+// returned func unregisters
+func (d *debugVarsRegistry) register(configName string, state *tunnelState) func() {
+	d.publishOnce.Do(func() {
+		expvar.Publish("holepunch", expvar.Func(d.collect))
+	})
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.tunnels[configName] = state
+
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		if d.tunnels[configName] == state {
+			delete(d.tunnels, configName)
+		}
+	}
+}
+
+func (d *debugVarsRegistry) collect() interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	collected := map[string]debugVarsTunnel{}
+
+	for configName, state := range d.tunnels {
+		status := state.snapshot()
+		reconnects, bytesTransferred := state.counters()
+
+		tunnel := debugVarsTunnel{
+			Connected:  status.Connected,
+			Reconnects: reconnects,
+			Forwards:   map[string]debugVarsForwardStat{},
+		}
+
+		for _, forward := range status.Forwards {
+			tunnel.ActiveConnections += forward.ActiveConnections
+			tunnel.TotalConnections += forward.TotalConnections
+			tunnel.BytesTransferred += bytesTransferred[forward.Forward]
+
+			tunnel.Forwards[forward.Forward] = debugVarsForwardStat{
+				ActiveConnections: forward.ActiveConnections,
+				TotalConnections:  forward.TotalConnections,
+				BytesTransferred:  bytesTransferred[forward.Forward],
+			}
+		}
+
+		collected[configName] = tunnel
+	}
+
+	return collected
+}
+
+// /debug/vars has our stats (expvar "holepunch") along with Go runtime's memstats and cmdline
+func serveDebugVars(addr string) {
+	log := newLogger("serveDebugVars")
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	log.Info(fmt.Sprintf("listening on %s", addr))
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Error(err.Error())
+	}
+}
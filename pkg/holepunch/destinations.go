@@ -0,0 +1,102 @@
+package holepunch
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var errDestinationNotAllowed = errors.New("not in allowed_destinations")
+
+// one allowed_destinations item: "<host>[:<port>]", where host is a glob like
+// "*.internal.example.com", an IP or a CIDR, and port is a number or "*" (= default)
+type destinationPattern struct {
+	hostGlob string     // lowercased. empty if ipNet is used
+	ipNet    *net.IPNet // for IPs and CIDRs
+	port     int        // 0 = any
+}
+
+func parseDestinationPattern(pattern string) (destinationPattern, error) {
+	host, port, err := net.SplitHostPort(pattern)
+	if err != nil { // no port (or IPv6 without brackets)
+		host, port = pattern, "*"
+	}
+
+	parsed := destinationPattern{}
+
+	if port != "*" {
+		portNum, err := strconv.Atoi(port)
+		if err != nil || portNum < 1 || portNum > 65535 {
+			return parsed, fmt.Errorf("Invalid port in allowed_destinations: %s", pattern)
+		}
+
+		parsed.port = portNum
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * len(ip)
+		if ipv4 := ip.To4(); ipv4 != nil {
+			ip, bits = ipv4, 32
+		}
+
+		parsed.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return parsed, nil
+	}
+
+	if strings.Contains(host, "/") {
+		_, ipNet, err := net.ParseCIDR(host)
+		if err != nil {
+			return parsed, fmt.Errorf("Invalid CIDR in allowed_destinations: %s", pattern)
+		}
+
+		parsed.ipNet = ipNet
+		return parsed, nil
+	}
+
+	if _, err := path.Match(host, ""); err != nil {
+		return parsed, fmt.Errorf("Invalid glob in allowed_destinations: %s", pattern)
+	}
+
+	parsed.hostGlob = strings.ToLower(host)
+
+	return parsed, nil
+}
+
+// destination is host:port. hostnames are resolved by the SSH server, so IP and CIDR patterns
+// only match destinations that are given as IPs
+func (d destinationPattern) matches(destination string) bool {
+	host, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		return false
+	}
+
+	if d.port != 0 && port != strconv.Itoa(d.port) {
+		return false
+	}
+
+	if d.ipNet != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && d.ipNet.Contains(ip)
+	}
+
+	matched, _ := path.Match(d.hostGlob, strings.ToLower(host))
+	return matched
+}
+
+// no allowlist means all destinations are allowed
+func (forward *Forward) destinationAllowed(destination string) bool {
+	if len(forward.allowedDestinations) == 0 {
+		return true
+	}
+
+	for _, pattern := range forward.allowedDestinations {
+		if pattern.matches(destination) {
+			return true
+		}
+	}
+
+	return false
+}
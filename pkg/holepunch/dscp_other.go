@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package holepunch
+
+import (
+	"net"
+)
+
+// Windows ignores IP_TOS set by applications (QoS is set by policy instead). dscp is reported
+// as ignored by validate-config
+const dscpSupported = false
+
+func setDscp(conn net.Conn, dscp int) error {
+	return nil
+}
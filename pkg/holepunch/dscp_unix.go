@@ -0,0 +1,43 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package holepunch
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+)
+
+const dscpSupported = true
+
+// only applies to TCP connections (not SSH channels or Unix sockets). DSCP is the upper six
+// bits of IPv4's TOS byte and IPv6's traffic class
+func setDscp(conn net.Conn, dscp int) error {
+	tcpConn, isTcp := conn.(*net.TCPConn)
+	if !isTcp {
+		return nil
+	}
+
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	isIpv4 := true
+	if localAddr, ok := tcpConn.LocalAddr().(*net.TCPAddr); ok && localAddr.IP.To4() == nil {
+		isIpv4 = false
+	}
+
+	var errSetsockopt error
+	if err := rawConn.Control(func(fd uintptr) {
+		if isIpv4 {
+			errSetsockopt = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, dscp<<2)
+		} else {
+			errSetsockopt = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, dscp<<2)
+		}
+	}); err != nil {
+		return err
+	}
+
+	return errSetsockopt
+}
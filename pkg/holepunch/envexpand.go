@@ -0,0 +1,120 @@
+package holepunch
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// expands ${VAR} and $VAR (from ENV) in fields where it's useful for reusing one config across
+// environments: addresses, usernames, file paths and websocket_headers. not in hook commands
+// (the shell expands those) or keyboard-interactive responses, where "$" is likely to be
+// literal. "$$" is a "$". an unset variable is an error instead of silently becoming ""
+func expandEnvInConfig(conf *Configuration) error {
+	expander := &envExpander{}
+
+	for i := range conf.SshServers {
+		expander.sshServer(fmt.Sprintf("ssh_servers[%d]", i), &conf.SshServers[i])
+	}
+
+	for i := range conf.Forwards {
+		forward := &conf.Forwards[i]
+		field := fmt.Sprintf("forwards[%d]", i)
+
+		expander.endpoint(field+".local", &forward.Local)
+		expander.endpoint(field+".remote", &forward.Remote)
+
+		for j := range forward.LocalBackends {
+			expander.endpoint(fmt.Sprintf("%s.local_backends[%d]", field, j), &forward.LocalBackends[j])
+		}
+
+		expander.expand(field+".tls_cert_path", &forward.TlsCertPath)
+		expander.expand(field+".tls_key_path", &forward.TlsKeyPath)
+	}
+
+	expander.expand("metrics_listen_addr", &conf.MetricsListenAddr)
+	expander.expand("health_listen_addr", &conf.HealthListenAddr)
+	expander.expand("debug_listen_addr", &conf.DebugListenAddr)
+	expander.expand("control_socket_path", &conf.ControlSocketPath)
+	expander.expand("access_log_path", &conf.AccessLogPath)
+
+	return expander.err
+}
+
+// remembers the first error, so callers don't need to check each field
+type envExpander struct {
+	err error
+}
+
+func (e *envExpander) sshServer(field string, server *SshServer) {
+	e.expand(field+".address", &server.Address)
+	e.expand(field+".username", &server.Username)
+	e.expand(field+".private_key_file_path", &server.PrivateKeyFilePath)
+
+	for i := range server.PrivateKeyFilePaths {
+		e.expand(fmt.Sprintf("%s.private_key_file_paths[%d]", field, i), &server.PrivateKeyFilePaths[i])
+	}
+
+	e.expand(field+".certificate_file_path", &server.CertificateFilePath)
+	e.expand(field+".known_hosts_file_path", &server.KnownHostsFilePath)
+	e.expand(field+".websocket_auth_token_file", &server.WebsocketAuthTokenFile)
+	e.expand(field+".websocket_host", &server.WebsocketHost)
+
+	for _, key := range sortedKeys(server.WebsocketHeaders) { // for deterministic errors
+		value := server.WebsocketHeaders[key]
+		e.expand(fmt.Sprintf("%s.websocket_headers.%s", field, key), &value)
+		server.WebsocketHeaders[key] = value
+	}
+	e.expand(field+".client_cert_path", &server.ClientCertPath)
+	e.expand(field+".client_key_path", &server.ClientKeyPath)
+	e.expand(field+".ca_cert_path", &server.CaCertPath)
+	e.expand(field+".proxy_url", &server.ProxyURL)
+
+	if server.JumpHost != nil {
+		e.sshServer(field+".jump_host", server.JumpHost)
+	}
+}
+
+func (e *envExpander) endpoint(field string, endpoint *Endpoint) {
+	e.expand(field+".host", &endpoint.Host)
+	e.expand(field+".socket", &endpoint.Socket)
+}
+
+func (e *envExpander) expand(field string, value *string) {
+	if e.err != nil || !strings.Contains(*value, "$") {
+		return
+	}
+
+	unset := []string{}
+
+	expanded := os.Expand(*value, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+
+		envValue, isSet := os.LookupEnv(name)
+		if !isSet {
+			unset = append(unset, name)
+		}
+
+		return envValue
+	})
+
+	if len(unset) > 0 {
+		e.err = fmt.Errorf("%s: ENV variable %s is not set", field, strings.Join(unset, ", "))
+		return
+	}
+
+	*value = expanded
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,48 @@
+package holepunch
+
+import (
+	"testing"
+)
+
+func TestWebsocketHeadersAreExpanded(t *testing.T) {
+	t.Setenv("HOLEPUNCH_TEST_TOKEN", "s3cret")
+
+	conf := &Configuration{SshServers: []SshServer{{
+		WebsocketHeaders: map[string]string{
+			"Authorization": "Bearer ${HOLEPUNCH_TEST_TOKEN}",
+			"X-Price":       "$$5",
+		},
+	}}}
+
+	if err := expandEnvInConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	headers, err := websocketHeaders(conf.SshServers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if auth := headers.Get("Authorization"); auth != "Bearer s3cret" {
+		t.Errorf("Authorization = %s", auth)
+	}
+
+	if price := headers.Get("X-Price"); price != "$5" {
+		t.Errorf("X-Price = %s", price)
+	}
+}
+
+func TestWebsocketHeaderWithUnsetEnvIsError(t *testing.T) {
+	conf := &Configuration{SshServers: []SshServer{{
+		WebsocketHeaders: map[string]string{"Authorization": "Bearer ${HOLEPUNCH_TEST_UNSET}"},
+	}}}
+
+	err := expandEnvInConfig(conf)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	if expected := "ssh_servers[0].websocket_headers.Authorization: ENV variable HOLEPUNCH_TEST_UNSET is not set"; err.Error() != expected {
+		t.Errorf("error %q; expected %q", err.Error(), expected)
+	}
+}
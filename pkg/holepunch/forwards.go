@@ -0,0 +1,125 @@
+package holepunch
+
+import (
+	"strings"
+)
+
+// for listing forwards
+type ForwardSummary struct {
+	Direction string `json:"direction"`
+	Local     string `json:"local"`
+	Remote    string `json:"remote"`
+	// only options that differ from defaults
+	Options map[string]interface{} `json:"options"`
+}
+
+func SummarizeForward(forward Forward) ForwardSummary {
+	remote := forward.Remote.String()
+	if forward.Direction == forwardDirectionSocks {
+		remote = "(chosen by client)"
+	}
+
+	options := map[string]interface{}{}
+
+	if forward.Disabled {
+		options["disabled"] = true
+	}
+
+	if forward.PortCount > 1 {
+		options["port_count"] = forward.PortCount
+	}
+
+	if len(forward.AllowedSourceCIDRs) > 0 {
+		options["allowed_source_cidrs"] = forward.AllowedSourceCIDRs
+	}
+
+	if len(forward.AllowedDestinations) > 0 {
+		options["allowed_destinations"] = forward.AllowedDestinations
+	}
+
+	if forward.MaxConcurrentConnections > 0 {
+		options["max_concurrent_connections"] = forward.MaxConcurrentConnections
+		options["over_limit_behavior"] = forward.OverLimitBehavior
+	}
+
+	if forward.IdleTimeout.Duration != 0 {
+		options["idle_timeout"] = forward.IdleTimeout.String()
+	}
+
+	if forward.MaxConnectionDuration.Duration != 0 {
+		options["max_connection_duration"] = forward.MaxConnectionDuration.String()
+	}
+
+	if forward.MaxBytesPerSecondUp > 0 {
+		options["max_bytes_per_second_up"] = forward.MaxBytesPerSecondUp
+	}
+
+	if forward.MaxBytesPerSecondDown > 0 {
+		options["max_bytes_per_second_down"] = forward.MaxBytesPerSecondDown
+	}
+
+	if forward.LocalDialRetries > 0 {
+		options["local_dial_retries"] = forward.LocalDialRetries
+	}
+
+	if forward.LocalDialTimeout.Duration != defaultLocalDialTimeout {
+		options["local_dial_timeout"] = forward.LocalDialTimeout.String()
+	}
+
+	if forward.LocalResolveFresh {
+		options["local_resolve_fresh"] = true
+	}
+
+	if forward.LocalNetwork != "" {
+		options["local_network"] = forward.LocalNetwork
+	}
+
+	if forward.SendProxyProtocol != "" {
+		options["send_proxy_protocol"] = forward.SendProxyProtocol
+	}
+
+	if forward.PipeBufferSize != defaultPipeBufferSize {
+		options["pipe_buffer_size"] = forward.PipeBufferSize
+	}
+
+	if forward.EnableNagle {
+		options["enable_nagle"] = true
+	}
+
+	if forward.DSCP != 0 {
+		options["dscp"] = forward.DSCP
+	}
+
+	if forward.RetryListen {
+		options["retry_listen"] = true
+	}
+
+	if forward.Compress {
+		options["compress"] = true
+	}
+
+	if forward.tlsCertificates != nil {
+		options["tls_certificates"] = len(forward.tlsCertificates.pairs)
+	}
+
+	if forward.CircuitBreakerThreshold > 0 {
+		options["circuit_breaker_threshold"] = forward.CircuitBreakerThreshold
+	}
+
+	if len(forward.LocalBackends) > 0 {
+		backends := []string{}
+		for _, backend := range forward.LocalBackends {
+			backends = append(backends, backend.String())
+		}
+
+		options["local_backends"] = strings.Join(backends, ",")
+		options["load_balance_policy"] = forward.LoadBalancePolicy
+	}
+
+	return ForwardSummary{
+		Direction: forward.Direction,
+		Local:     forward.Local.String(),
+		Remote:    remote,
+		Options:   options,
+	}
+}
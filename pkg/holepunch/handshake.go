@@ -0,0 +1,195 @@
+package holepunch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strings"
+	"sync"
+)
+
+// what was negotiated with the server, for debugging and auditing
+type handshakeDetails struct {
+	serverVersion        string
+	hostKey              string // type and fingerprint
+	keyExchange          string
+	cipherClientToServer string
+	cipherServerToClient string
+	macClientToServer    string
+	macServerToClient    string
+}
+
+func (h *handshakeDetails) String() string {
+	return fmt.Sprintf(
+		"server %s, host key %s, kex %s, cipher %s / %s, MAC %s / %s",
+		h.serverVersion,
+		h.hostKey,
+		h.keyExchange,
+		h.cipherClientToServer,
+		h.cipherServerToClient,
+		h.macClientToServer,
+		h.macServerToClient)
+}
+
+// the SSH library doesn't expose negotiated algorithms, so we determine them from the
+// server's KEXINIT the same way the library does: first of our algorithms that the server
+// also supports. "?" if we didn't see the server's KEXINIT
+func describeHandshake(
+	sconn ssh.Conn,
+	serverKexInit *kexInitMsg,
+	ourConfig ssh.Config,
+	hostKey ssh.PublicKey,
+) *handshakeDetails {
+	details := &handshakeDetails{
+		serverVersion:        string(sconn.ServerVersion()),
+		hostKey:              "?",
+		keyExchange:          "?",
+		cipherClientToServer: "?",
+		cipherServerToClient: "?",
+		macClientToServer:    "?",
+		macServerToClient:    "?",
+	}
+
+	if hostKey != nil {
+		details.hostKey = hostKey.Type() + " " + ssh.FingerprintSHA256(hostKey)
+	}
+
+	if serverKexInit == nil {
+		return details
+	}
+
+	ourConfig.SetDefaults() // the library does the same
+
+	details.keyExchange = firstCommonAlgorithm(ourConfig.KeyExchanges, serverKexInit.KexAlgos)
+	details.cipherClientToServer = firstCommonAlgorithm(ourConfig.Ciphers, serverKexInit.CiphersClientServer)
+	details.cipherServerToClient = firstCommonAlgorithm(ourConfig.Ciphers, serverKexInit.CiphersServerClient)
+	details.macClientToServer = macFor(details.cipherClientToServer, ourConfig.MACs, serverKexInit.MACsClientServer)
+	details.macServerToClient = macFor(details.cipherServerToClient, ourConfig.MACs, serverKexInit.MACsServerClient)
+
+	return details
+}
+
+// AEAD ciphers have integrated authentication
+func macFor(cipher string, ours []string, theirs []string) string {
+	if cipher == "chacha20-poly1305@openssh.com" || strings.HasSuffix(cipher, "-gcm@openssh.com") {
+		return "(implicit)"
+	}
+
+	return firstCommonAlgorithm(ours, theirs)
+}
+
+func firstCommonAlgorithm(ours []string, theirs []string) string {
+	for _, our := range ours {
+		for _, their := range theirs {
+			if our == their {
+				return our
+			}
+		}
+	}
+
+	return "?"
+}
+
+// https://tools.ietf.org/html/rfc4253#section-7.1
+type kexInitMsg struct {
+	Cookie                  [16]byte `sshtype:"20"`
+	KexAlgos                []string
+	ServerHostKeyAlgos      []string
+	CiphersClientServer     []string
+	CiphersServerClient     []string
+	MACsClientServer        []string
+	MACsServerClient        []string
+	CompressionClientServer []string
+	CompressionServerClient []string
+	LanguagesClientServer   []string
+	LanguagesServerClient   []string
+	FirstKexFollows         bool
+	Reserved                uint32
+}
+
+// see what the server sends until we've seen its KEXINIT, which is the first binary packet
+// after the version line (and thus not yet encrypted)
+type kexInitSniffer struct {
+	net.Conn
+	mu       sync.Mutex
+	received []byte
+	done     bool
+	kexInit  *kexInitMsg
+}
+
+const kexInitSnifferMaxBytes = 256 * 1024 // max packet size is 35000 bytes, but be generous
+
+func (k *kexInitSniffer) Read(b []byte) (int, error) {
+	n, err := k.Conn.Read(b)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if n > 0 && !k.done {
+		k.received = append(k.received, b[:n]...)
+		k.tryParse()
+	}
+
+	return n, err
+}
+
+func (k *kexInitSniffer) serverKexInit() *kexInitMsg {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.kexInit
+}
+
+func (k *kexInitSniffer) tryParse() {
+	if len(k.received) > kexInitSnifferMaxBytes {
+		k.giveUp()
+		return
+	}
+
+	// server can send other lines before the version line
+	versionLineStart := 0
+	for !bytes.HasPrefix(k.received[versionLineStart:], []byte("SSH-")) {
+		lineEnd := bytes.IndexByte(k.received[versionLineStart:], '\n')
+		if lineEnd == -1 {
+			return // need more data
+		}
+
+		versionLineStart += lineEnd + 1
+	}
+
+	versionLineEnd := bytes.IndexByte(k.received[versionLineStart:], '\n')
+	if versionLineEnd == -1 {
+		return
+	}
+
+	// uint32 packet_length, byte padding_length, payload, padding
+	packet := k.received[versionLineStart+versionLineEnd+1:]
+	if len(packet) < 5 {
+		return
+	}
+
+	packetLength := int(binary.BigEndian.Uint32(packet))
+	paddingLength := int(packet[4])
+	if packetLength > kexInitSnifferMaxBytes || paddingLength+1 > packetLength {
+		k.giveUp()
+		return
+	}
+
+	if len(packet) < 4+packetLength {
+		return
+	}
+
+	kexInit := &kexInitMsg{}
+	if err := ssh.Unmarshal(packet[5:4+packetLength-paddingLength], kexInit); err == nil {
+		k.kexInit = kexInit
+	}
+
+	k.giveUp()
+}
+
+func (k *kexInitSniffer) giveUp() {
+	k.done = true
+	k.received = nil
+}
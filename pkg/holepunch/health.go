@@ -0,0 +1,248 @@
+package holepunch
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// one forward in /health and control socket status
+type ForwardState struct {
+	Forward   string `json:"forward"`
+	Listening bool   `json:"listening"`
+	// actual address listened on. differs from Forward when server assigned the port
+	ListeningAddr     string `json:"listening_addr,omitempty"`
+	ActiveConnections int    `json:"active_connections"`
+	TotalConnections  int    `json:"total_connections"` // since start
+	// Listen() and Accept() failures of this forward alone (not counting the SSH connection
+	// dying), since start
+	ListenerErrors    int    `json:"listener_errors"`
+	LastListenerError string `json:"last_listener_error,omitempty"`
+}
+
+type tunnelStatus struct {
+	Connected bool           `json:"connected"`
+	Forwards  []ForwardState `json:"forwards"`
+}
+
+// healthy = connected to SSH server and all forwards have active listeners
+func (t *tunnelStatus) Healthy() bool {
+	if !t.Connected {
+		return false
+	}
+
+	for _, forward := range t.Forwards {
+		if !forward.Listening {
+			return false
+		}
+	}
+
+	return true
+}
+
+// shared state of a tunnel, updated by the connection and forward goroutines
+type tunnelState struct {
+	mu               sync.Mutex
+	status           tunnelStatus
+	startedAt        time.Time
+	connectedAt      time.Time         // zero if not connected
+	reconnects       int               // since start
+	bytesTransferred map[string]*int64 // by forward. atomic, since updated on every read/write
+}
+
+func newTunnelState(forwards []Forward) *tunnelState {
+	state := &tunnelState{
+		startedAt:        time.Now(),
+		bytesTransferred: map[string]*int64{},
+	}
+	state.setForwards(forwards)
+	return state
+}
+
+// state of forwards that remain (on config reload) is retained
+func (t *tunnelState) setForwards(forwards []Forward) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	previousByKey := map[string]ForwardState{}
+	for _, previous := range t.status.Forwards {
+		previousByKey[previous.Forward] = previous
+	}
+
+	t.status.Forwards = []ForwardState{}
+	for _, forward := range forwards {
+		key := forward.listenEndpoint().String()
+
+		t.status.Forwards = append(t.status.Forwards, ForwardState{
+			Forward:           key,
+			Listening:         previousByKey[key].Listening,
+			ListeningAddr:     previousByKey[key].ListeningAddr,
+			ActiveConnections: previousByKey[key].ActiveConnections,
+			TotalConnections:  previousByKey[key].TotalConnections,
+			ListenerErrors:    previousByKey[key].ListenerErrors,
+			LastListenerError: previousByKey[key].LastListenerError,
+		})
+
+		if _, exists := t.bytesTransferred[key]; !exists {
+			t.bytesTransferred[key] = new(int64)
+		}
+	}
+}
+
+// listeners don't survive the connection, so disconnect marks them all down
+func (t *tunnelState) setConnected(connected bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.status.Connected = connected
+
+	if connected {
+		t.connectedAt = time.Now()
+	} else {
+		t.connectedAt = time.Time{}
+
+		for i := range t.status.Forwards {
+			t.status.Forwards[i].Listening = false
+			t.status.Forwards[i].ListeningAddr = ""
+		}
+	}
+}
+
+// listenAddr is nil when not listening
+func (t *tunnelState) setListening(forward Forward, listenAddr net.Addr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := forward.listenEndpoint().String()
+
+	for i := range t.status.Forwards {
+		if t.status.Forwards[i].Forward == key {
+			t.status.Forwards[i].Listening = listenAddr != nil
+			t.status.Forwards[i].ListeningAddr = ""
+			if listenAddr != nil {
+				t.status.Forwards[i].ListeningAddr = listenAddr.String()
+			}
+		}
+	}
+}
+
+func (t *tunnelState) listenerFailed(forward Forward, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := forward.listenEndpoint().String()
+
+	for i := range t.status.Forwards {
+		if t.status.Forwards[i].Forward == key {
+			t.status.Forwards[i].ListenerErrors++
+			t.status.Forwards[i].LastListenerError = err.Error()
+		}
+	}
+}
+
+// delta is +1 when a connection opens and -1 when it closes
+func (t *tunnelState) addActiveConnections(forward Forward, delta int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := forward.listenEndpoint().String()
+
+	for i := range t.status.Forwards {
+		if t.status.Forwards[i].Forward == key {
+			t.status.Forwards[i].ActiveConnections += delta
+
+			if delta > 0 {
+				t.status.Forwards[i].TotalConnections += delta
+			}
+		}
+	}
+}
+
+// counter of bytes piped in both directions, for updating with sync/atomic
+func (t *tunnelState) bytesCounter(forward Forward) *int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := forward.listenEndpoint().String()
+
+	if _, exists := t.bytesTransferred[key]; !exists {
+		t.bytesTransferred[key] = new(int64)
+	}
+
+	return t.bytesTransferred[key]
+}
+
+func (t *tunnelState) countReconnect() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.reconnects++
+}
+
+// reconnects and bytes transferred (by forward) since start
+func (t *tunnelState) counters() (int, map[string]int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	bytesTransferred := map[string]int64{}
+	for key, counter := range t.bytesTransferred {
+		bytesTransferred[key] = atomic.LoadInt64(counter)
+	}
+
+	return t.reconnects, bytesTransferred
+}
+
+// how long since the tunnel started and how long the current SSH connection has been up
+// (0 if not connected)
+func (t *tunnelState) uptimes() (time.Duration, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	connectedFor := time.Duration(0)
+	if !t.connectedAt.IsZero() {
+		connectedFor = time.Since(t.connectedAt)
+	}
+
+	return time.Since(t.startedAt), connectedFor
+}
+
+func (t *tunnelState) snapshot() tunnelStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return tunnelStatus{
+		Connected: t.status.Connected,
+		Forwards:  append([]ForwardState{}, t.status.Forwards...),
+	}
+}
+
+func serveHealth(addr string, state *tunnelState) {
+	log := newLogger("serveHealth")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		status := state.snapshot()
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if status.Healthy() {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Error(err.Error())
+		}
+	})
+
+	log.Info(fmt.Sprintf("listening on %s", addr))
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Error(err.Error())
+	}
+}
@@ -0,0 +1,1299 @@
+package holepunch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/function61/gokit/backoff"
+	"github.com/function61/holepunch-server/pkg/tcpkeepalive"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var version = "dev" // replaced dynamically at build time. see also version.go
+
+// connects to the other end of the forward on behalf of the client
+type dialTargetFn func(ctx context.Context, client net.Conn) (net.Conn, error)
+
+// pipes client to whatever dialTarget connects to (local service for reverse forwards,
+// remote service via SSH server for local and SOCKS forwards)
+// cancelling ctx aborts a pending dial, but not an established connection
+func handleClient(
+	ctx context.Context,
+	client net.Conn,
+	forward Forward,
+	dialTarget dialTargetFn,
+	bytesTransferred *int64,
+	accessLog *accessLog,
+	connectionHandler ConnectionHandler,
+	channelSlots sshChannelSlots,
+) {
+	defer client.Close()
+
+	// unblocks whatever we're waiting on (TLS handshake, queueing, dialing, piping) when the SSH
+	// connection is torn down
+	handled := make(chan struct{})
+	defer close(handled)
+
+	go func(rawClient net.Conn) {
+		select {
+		case <-ctx.Done():
+			rawClient.Close()
+		case <-handled:
+		}
+	}(client)
+
+	log := newLogger("handleClient")
+
+	acceptedAt := time.Now()
+	stats := &connectionStats{}
+	closeReason := closeReasonClosed
+	var closeErr error
+
+	defer func() {
+		accessLog.record(client.RemoteAddr(), forward, acceptedAt, stats, closeReason, closeErr)
+	}()
+
+	if !forward.sourceAllowed(client.RemoteAddr()) {
+		log.Warn(fmt.Sprintf(
+			"rejected %s for %s: not in allowed_source_cidrs",
+			client.RemoteAddr(),
+			forward.listenEndpoint().String()))
+		closeReason = closeReasonSourceNotAllowed
+		return
+	}
+
+	metricsLabel := forward.listenEndpoint().String()
+	metrics.connectionsAccepted.WithLabelValues(metricsLabel).Inc()
+
+	// acquired before dialing so that the target isn't burdened over the limit
+	if !acquireConnectionSlot(ctx, client, forward) {
+		closeReason = closeReasonOverLimit
+		return
+	}
+	defer releaseConnectionSlot(forward)
+
+	// after the forward's own slot, so that connections queueing for that don't hold these
+	if !acquireTotalConnectionSlot(client, forward) {
+		closeReason = closeReasonOverTotalLimit
+		return
+	}
+	defer releaseTotalConnectionSlot(forward)
+
+	// last, so that per-forward limits apply first. for reverse forwards the server has
+	// already opened the channel, and waiting holds off piping over it
+	if !channelSlots.acquire(ctx, client, forward) {
+		closeReason = closeReasonOverLimit
+		return
+	}
+	defer channelSlots.release()
+
+	metrics.connectionsActive.WithLabelValues(metricsLabel).Inc()
+	defer metrics.connectionsActive.WithLabelValues(metricsLabel).Dec()
+
+	// per-connection messages are debug-level to not flood logs on busy tunnels
+	log.Debug(fmt.Sprintf("%s connected", client.RemoteAddr()))
+
+	if forward.tlsCertificates != nil {
+		tlsClient, err := terminateTls(ctx, client, forward.tlsCertificates)
+		if err != nil {
+			log.Warn(fmt.Sprintf("%s TLS handshake: %s", client.RemoteAddr(), err.Error()))
+			closeReason, closeErr = closeReasonTlsHandshake, err
+			return
+		}
+
+		client = tlsClient
+	}
+
+	connectedAt := time.Now()
+
+	defer func() {
+		log.Debug(fmt.Sprintf(
+			"%s closed after %s; %d bytes from client, %d bytes to client",
+			client.RemoteAddr(),
+			time.Since(connectedAt).Round(time.Millisecond),
+			stats.bytesFromClient,
+			stats.bytesToClient))
+	}()
+
+	handlerCalledDialAndPipe := false
+
+	err := connectionHandler(ctx, client, forward, func(conn net.Conn) error {
+		handlerCalledDialAndPipe = true
+
+		closeReason, closeErr = dialAndPipe(ctx, conn, forward, dialTarget, stats, bytesTransferred)
+		return closeErr
+	})
+	if err != nil && !handlerCalledDialAndPipe {
+		log.Warn(fmt.Sprintf("%s rejected by connection handler: %s", client.RemoteAddr(), err.Error()))
+		closeReason, closeErr = closeReasonRejectedByHandler, err
+	}
+}
+
+// the default ConnectionHandler's work. returns accessLog close reason (and error, if any)
+func dialAndPipe(
+	ctx context.Context,
+	client net.Conn,
+	forward Forward,
+	dialTarget dialTargetFn,
+	stats *connectionStats,
+	bytesTransferred *int64,
+) (string, error) {
+	log := newLogger("handleClient")
+
+	remote, err := dialTarget(ctx, client)
+	if err == errCircuitOpen { // logged when the circuit opened, not for each rejected connection
+		return closeReasonCircuitOpen, err
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("dial INTO target error: %s", err.Error()))
+		return closeReasonDialFailed, err
+	}
+
+	if forward.EnableNagle {
+		for _, conn := range []net.Conn{client, remote} {
+			if err := enableNagle(conn); err != nil {
+				log.Warn(fmt.Sprintf("enabling Nagle: %s", err.Error()))
+			}
+		}
+	}
+
+	if forward.DSCP != 0 {
+		for _, conn := range []net.Conn{client, remote} {
+			if err := setDscp(conn, forward.DSCP); err != nil {
+				log.Warn(fmt.Sprintf("setting DSCP: %s", err.Error()))
+			}
+		}
+	}
+
+	pipeClient, pipeRemote := limitBandwidth(instrumentClient(client, forward, stats, bytesTransferred), remote, forward)
+
+	// outermost, so that bandwidth limits apply to compressed bytes
+	pipeClient, pipeRemote = compressSshSide(pipeClient, pipeRemote, forward)
+
+	var watchdog *idleWatchdog
+	if forward.IdleTimeout.Duration > 0 {
+		pipeClient, pipeRemote, watchdog = withIdleTimeout(pipeClient, pipeRemote, forward.IdleTimeout.Duration)
+		defer watchdog.stopWatching()
+	}
+
+	maxDurationReached := int32(0)
+	if forward.MaxConnectionDuration.Duration > 0 {
+		maxDurationTimer := time.AfterFunc(forward.MaxConnectionDuration.Duration, func() {
+			atomic.StoreInt32(&maxDurationReached, 1)
+
+			pipeClient.Close()
+			pipeRemote.Close()
+		})
+		defer maxDurationTimer.Stop()
+	}
+
+	err = pipe(pipeClient, "client", pipeRemote, "remote", forward.PipeBufferSize)
+
+	switch {
+	case atomic.LoadInt32(&maxDurationReached) == 1: // pipe error is a consequence of our Close()
+
+		metrics.connectionsMaxDuration.WithLabelValues(forward.listenEndpoint().String()).Inc()
+
+		// not debug like other per-connection messages, so operators see when the cap is hit
+		log.Info(fmt.Sprintf(
+			"%s: max_connection_duration (%s) reached; closed",
+			client.RemoteAddr(),
+			forward.MaxConnectionDuration.String()))
+
+		return closeReasonMaxDurationReached, nil
+	case watchdog != nil && watchdog.hasTimedOut(): // pipe error is a consequence of our Close()
+		log.Debug(fmt.Sprintf("idle for %s; closing", forward.IdleTimeout.String()))
+
+		return closeReasonIdleTimeout, nil
+	case err != nil && isBenignPipeError(err):
+		log.Debug(err.Error())
+	case err != nil:
+		log.Error(err.Error())
+
+		return closeReasonError, err
+	}
+
+	return closeReasonClosed, nil
+}
+
+// looks up endpoint.Host (Local or one of LocalBackends) and returns the next of its addresses
+// (in host:port form), so connections are spread over all of them. only addresses of
+// LocalNetwork's family count
+func resolveRoundRobin(ctx context.Context, forward Forward, endpoint Endpoint) (string, error) {
+	ipNetwork := "ip"
+	switch forward.LocalNetwork {
+	case "tcp4":
+		ipNetwork = "ip4"
+	case "tcp6":
+		ipNetwork = "ip6"
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, ipNetwork, endpoint.Host)
+	if err != nil {
+		return "", err
+	}
+
+	if len(ips) == 0 { // shouldn't happen, but guard against division by zero
+		return "", fmt.Errorf("no addresses for %s", endpoint.Host)
+	}
+
+	next := atomic.AddUint64(forward.resolveCounter, 1)
+
+	return net.JoinHostPort(ips[next%uint64(len(ips))].String(), strconv.Itoa(endpoint.Port)), nil
+}
+
+// only applies to TCP connections (not SSH channels or Unix sockets)
+func enableNagle(conn net.Conn) error {
+	if tcpConn, isTcp := conn.(*net.TCPConn); isTcp {
+		return tcpConn.SetNoDelay(false)
+	}
+
+	return nil
+}
+
+// no-op if forward has no MaxConcurrentConnections. returns false if client was rejected (or
+// ctx cancelled while queueing)
+func acquireConnectionSlot(ctx context.Context, client net.Conn, forward Forward) bool {
+	if forward.connectionSlots == nil {
+		return true
+	}
+
+	select {
+	case forward.connectionSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	log := newLogger("acquireConnectionSlot")
+
+	metricsLabel := forward.listenEndpoint().String()
+	metrics.connectionsOverLimit.WithLabelValues(metricsLabel).Inc()
+
+	if forward.OverLimitBehavior == overLimitReject {
+		log.Warn(fmt.Sprintf(
+			"%s: max_concurrent_connections (%d) reached; rejecting %s",
+			metricsLabel,
+			forward.MaxConcurrentConnections,
+			client.RemoteAddr()))
+		return false
+	}
+
+	log.Warn(fmt.Sprintf(
+		"%s: max_concurrent_connections (%d) reached; queueing %s",
+		metricsLabel,
+		forward.MaxConcurrentConnections,
+		client.RemoteAddr()))
+
+	select {
+	case forward.connectionSlots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func releaseConnectionSlot(forward Forward) {
+	if forward.connectionSlots != nil {
+		<-forward.connectionSlots
+	}
+}
+
+// no-op without MaxTotalConnections. never queues, since it's a safety valve and not a
+// way to share capacity between forwards
+func acquireTotalConnectionSlot(client net.Conn, forward Forward) bool {
+	if forward.totalSlots == nil {
+		return true
+	}
+
+	select {
+	case forward.totalSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	metricsLabel := forward.listenEndpoint().String()
+	metrics.connectionsOverTotalLimit.WithLabelValues(metricsLabel).Inc()
+
+	newLogger("acquireTotalConnectionSlot").Warn(fmt.Sprintf(
+		"max_total_connections (%d) reached; rejecting %s for %s",
+		cap(forward.totalSlots),
+		client.RemoteAddr(),
+		metricsLabel))
+
+	return false
+}
+
+func releaseTotalConnectionSlot(forward Forward) {
+	if forward.totalSlots != nil {
+		<-forward.totalSlots
+	}
+}
+
+func connectToSshAndServe(ctx context.Context, tun *tunnel, server *resolvedSshServer) error {
+	log := newLogger("connectToSshAndServe")
+	log.Info(fmt.Sprintf("connecting to %s", server.Address))
+
+	sshClient, handshake, errConnect := connectSsh(ctx, server)
+	if errConnect != nil {
+		return &connectError{errConnect}
+	}
+
+	log.Debug(fmt.Sprintf("handshake: %s", handshake.String()))
+
+	defer sshClient.Close()
+	defer log.Info("disconnecting")
+
+	log.Info("connected; starting to forward ports")
+
+	tun.notifier.notify(eventConnected, server.Address, nil)
+
+	metrics.sshConnectionUp.Inc()
+	defer metrics.sshConnectionUp.Dec()
+
+	tun.state.setConnected(true)
+	defer tun.state.setConnected(false)
+
+	// only the SSH transport dying is fatal to the whole connection. a forward's listener
+	// failing by itself is retried by that forward alone
+	transport := watchTransport(sshClient)
+
+	// cancelled when forwards should stop accepting new connections
+	forwardsCtx, stopForwards := context.WithCancel(context.Background())
+	defer stopForwards()
+
+	go func() {
+		select {
+		case <-transport.dead:
+			stopForwards()
+		case <-forwardsCtx.Done():
+		}
+	}()
+
+	activeConnections := &sync.WaitGroup{}
+
+	// cancelled on teardown, closing in-flight connections (they'd be piping over a dead SSH
+	// connection). unlike forwardsCtx, not cancelled for draining on shutdown
+	connectionsCtx, closeConnections := context.WithCancel(context.Background())
+
+	go func() {
+		select {
+		case <-transport.dead:
+			closeConnections()
+		case <-connectionsCtx.Done():
+		}
+	}()
+
+	running := newRunningForwards(
+		forwardsCtx,
+		connectionsCtx,
+		sshClient,
+		transport,
+		activeConnections,
+		tun.state,
+		tun.accessLog,
+		tun.connectionHandler,
+		newSshChannelSlots(server.MaxChannels))
+
+	defer func() {
+		closeConnections()
+		// the deferred Close() would come too late: closing only our end of an SSH channel
+		// doesn't unblock reads from it
+		sshClient.Close()
+		// after Close(), so closing remote listeners doesn't wait on an unresponsive server.
+		// stopped accept loops can't add to activeConnections while we wait for it
+		running.stopAll()
+		waitForClosedConnections(activeConnections)
+	}()
+
+	currentForwards, forwardsChanged := tun.forwards.get()
+
+	// initial Listen() failure is returned so misconfiguration is noticed immediately.
+	// closes SSH connection even if one forward Listen() fails. counts as failing to connect,
+	// so that a remote port that's always refused trips reconnect.max_attempts
+	if err := running.reconcile(currentForwards, true); err != nil {
+		return &connectError{err}
+	}
+
+	tun.hooks.run(eventConnected, server.Address, currentForwards)
+	defer func() {
+		// forwards can have changed by reload
+		forwards, _ := tun.forwards.get()
+		tun.hooks.run(eventDisconnected, server.Address, forwards)
+	}()
+
+	keepaliveCtx, stopKeepalive := context.WithCancel(ctx)
+	defer stopKeepalive()
+
+	keepaliveFailed := make(chan error, 1)
+
+	go sshKeepalive(
+		keepaliveCtx,
+		sshClient,
+		server.KeepaliveInterval.Duration,
+		server.KeepaliveCountMax,
+		keepaliveFailed)
+
+	if tun.conf.StatusLogInterval.Duration > 0 {
+		go logStatusPeriodically(keepaliveCtx, tun.state, tun.conf.StatusLogInterval.Duration)
+	}
+
+	var lifetimeExceeded <-chan time.Time // nil (= never) if no max lifetime
+	if server.MaxConnectionLifetime.Duration > 0 {
+		lifetimeTimer := time.NewTimer(server.MaxConnectionLifetime.Duration)
+		defer lifetimeTimer.Stop()
+
+		lifetimeExceeded = lifetimeTimer.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// stop accepting new connections but give in-flight ones a chance to finish. the
+			// remaining ones get force-closed with the SSH connection
+			stopForwards()
+			drainConnections(activeConnections, tun.conf.ShutdownGracePeriod.Duration)
+			return nil
+		case <-lifetimeExceeded:
+			log.Info(fmt.Sprintf("max_connection_lifetime (%s) reached", server.MaxConnectionLifetime.String()))
+
+			stopForwards()
+			drainConnections(activeConnections, tun.conf.ShutdownGracePeriod.Duration)
+			return errMaxConnectionLifetime
+		case err := <-keepaliveFailed:
+			return err
+		case <-transport.dead:
+			return transport.err()
+		case <-forwardsChanged: // config reloaded
+			currentForwards, forwardsChanged = tun.forwards.get()
+
+			running.reconcile(currentForwards, false) // errors are logged
+		}
+	}
+}
+
+// connection that stayed up at least this long resets the reconnect backoff
+const stableConnectionDuration = 60 * time.Second
+
+// connection was closed on purpose, to be re-established immediately
+var errMaxConnectionLifetime = errors.New("max_connection_lifetime reached")
+
+// from Client.Run() with Client.Once
+var ErrNotReconnecting = errors.New("not reconnecting (--once)")
+
+// failure to establish the SSH connection (or its forwards), as opposed to an established
+// one failing
+type connectError struct {
+	err error
+}
+
+func (c *connectError) Error() string {
+	return c.err.Error()
+}
+
+func (c *connectError) Unwrap() error {
+	return c.err
+}
+
+// SSH server with its authentication and host key verification ready to use
+type resolvedSshServer struct {
+	SshServer
+	auth            []ssh.AuthMethod
+	hostKeyCallback ssh.HostKeyCallback
+	jumpHost        *resolvedSshServer // nil if connecting directly
+}
+
+func resolveSshServer(server SshServer) (*resolvedSshServer, error) {
+	auth, err := authMethodsFromConfig(server)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := hostKeyCallbackFromConfig(server)
+	if err != nil {
+		return nil, err
+	}
+
+	var jumpHost *resolvedSshServer
+	if server.JumpHost != nil {
+		jumpHost, err = resolveSshServer(*server.JumpHost)
+		if err != nil {
+			return nil, fmt.Errorf("jump_host %s: %s", server.JumpHost.Address, err.Error())
+		}
+	}
+
+	return &resolvedSshServer{server, auth, hostKeyCallback, jumpHost}, nil
+}
+
+func resolveSshServers(servers []SshServer) ([]*resolvedSshServer, error) {
+	resolved := []*resolvedSshServer{}
+
+	for _, server := range servers {
+		resolvedServer, err := resolveSshServer(server)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", server.Address, err.Error())
+		}
+
+		resolved = append(resolved, resolvedServer)
+	}
+
+	return resolved, nil
+}
+
+func connectSsh(ctx context.Context, server *resolvedSshServer) (*ssh.Client, *handshakeDetails, error) {
+	sshConfig := &ssh.ClientConfig{
+		User:            server.Username,
+		Auth:            server.auth,
+		HostKeyCallback: server.hostKeyCallback,
+		Config: ssh.Config{
+			Ciphers:      server.Ciphers,
+			KeyExchanges: server.KeyExchanges,
+			MACs:         server.MACs,
+		},
+	}
+
+	if server.jumpHost != nil {
+		return connectSshViaJumpHost(ctx, server, sshConfig)
+	}
+
+	if isWebsocketAddress(server.Address) {
+		return connectSshWebsocket(ctx, server.SshServer, sshConfig)
+	}
+
+	if isTlsAddress(server.Address) {
+		return connectSshTls(ctx, server.SshServer, sshConfig)
+	}
+
+	return connectSshRegularTcp(ctx, server.SshServer, sshConfig)
+}
+
+func connectSshViaJumpHost(
+	ctx context.Context,
+	server *resolvedSshServer,
+	sshConfig *ssh.ClientConfig,
+) (*ssh.Client, *handshakeDetails, error) {
+	log := newLogger("connectSshViaJumpHost")
+	log.Debug(fmt.Sprintf("connecting to %s via jump host %s", server.Address, server.jumpHost.Address))
+
+	jumpClient, _, err := connectSsh(ctx, server.jumpHost)
+	if err != nil {
+		return nil, nil, fmt.Errorf("jump host %s: %w", server.jumpHost.Address, err)
+	}
+
+	conn, err := dialViaJumpHost(ctx, jumpClient, server.Address, server.ConnectTimeout.Duration)
+	if err != nil {
+		jumpClient.Close()
+		return nil, nil, fmt.Errorf("jump host %s: dial %s: %w", server.jumpHost.Address, server.Address, err)
+	}
+
+	sshClient, details, err := sshClientForConn(conn, server.Address, sshConfig)
+	if err != nil {
+		jumpClient.Close()
+		return nil, nil, err
+	}
+
+	// jump host connection is only needed for as long as the connection through it
+	go func() {
+		_ = sshClient.Wait()
+		jumpClient.Close()
+	}()
+
+	return sshClient, details, nil
+}
+
+// ssh.Client.Dial() takes no context and waits for the jump host to answer the channel open
+// for as long as it takes. if we give up, closing jumpClient (done by our caller) unblocks it
+func dialViaJumpHost(ctx context.Context, jumpClient *ssh.Client, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	dialed := make(chan dialResult, 1)
+	go func() {
+		conn, err := jumpClient.Dial("tcp", addr)
+		dialed <- dialResult{conn, err}
+	}()
+
+	select {
+	case result := <-dialed:
+		return result.conn, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type transportWatcher struct {
+	dead    chan struct{} // closed when SSH transport dies
+	waitErr error         // safe to read only after dead is closed
+}
+
+func watchTransport(sshClient *ssh.Client) *transportWatcher {
+	transport := &transportWatcher{
+		dead: make(chan struct{}),
+	}
+
+	go func() {
+		transport.waitErr = sshClient.Wait()
+		close(transport.dead)
+	}()
+
+	return transport
+}
+
+func (t *transportWatcher) err() error {
+	if t.waitErr == nil {
+		return errors.New("SSH connection closed")
+	}
+
+	return fmt.Errorf("SSH connection closed: %s", t.waitErr.Error())
+}
+
+func listenForForward(forward Forward, sshClient *ssh.Client) (net.Listener, error) {
+	log := newLogger("listenForForward")
+
+	switch forward.Direction {
+	case forwardDirectionLocal, forwardDirectionSocks:
+		if !isLoopbackBindAddress(forward.Local) {
+			log.Warn(fmt.Sprintf(
+				"%s is not a loopback address: the forward can be used from other machines",
+				forward.Local.String()))
+		}
+
+		if listener := activatedListenerFor(forward); listener != nil {
+			log.Info(fmt.Sprintf("listening local %s (socket from systemd)", forward.Local.String()))
+
+			return listener, nil
+		}
+
+		listener, err := net.Listen(forward.localNetwork(), forward.Local.address())
+		if err != nil {
+			return nil, err
+		}
+
+		if forward.Direction == forwardDirectionSocks {
+			log.Info(fmt.Sprintf("SOCKS5 proxy listening local %s", forward.Local.String()))
+		} else {
+			log.Info(fmt.Sprintf("listening local %s", forward.Local.String()))
+		}
+
+		return listener, nil
+	default:
+		// Listen on remote server port
+		sshTrace(fmt.Sprintf("global request: tcpip-forward %s", forward.Remote.String()))
+
+		listener, err := sshClient.Listen(forward.Remote.network(), forward.Remote.address())
+		if err != nil {
+			sshTrace(fmt.Sprintf("global request: tcpip-forward %s: %s", forward.Remote.String(), err.Error()))
+
+			return nil, describeRemoteListenError(forward, err)
+		}
+
+		sshTrace(fmt.Sprintf("global request: tcpip-forward %s: accepted", forward.Remote.String()))
+
+		// with port 0 the server chooses one
+		if !forward.Remote.isUnixSocket() && forward.Remote.Port == 0 {
+			log.Info(fmt.Sprintf(
+				"listening remote %s (server-assigned port for %s)",
+				listener.Addr().String(),
+				forward.Remote.String()))
+		} else {
+			log.Info(fmt.Sprintf("listening remote %s", forward.Remote.String()))
+		}
+
+		return listener, nil
+	}
+}
+
+// SSH protocol doesn't tell why the server refused, but a port that is already forwarded is the
+// usual reason. like when the previous connection hasn't timed out on the server yet
+func describeRemoteListenError(forward Forward, err error) error {
+	if !strings.Contains(err.Error(), "request denied by peer") {
+		return err
+	}
+
+	return fmt.Errorf(
+		"SSH server refused to listen on %s: port probably already forwarded (by another client or a stale session), or server disallows remote forwarding (AllowTcpForwarding, GatewayPorts)",
+		forward.Remote.String())
+}
+
+func dialTargetFor(forward Forward, sshClient *ssh.Client) dialTargetFn {
+	switch forward.Direction {
+	case forwardDirectionLocal, forwardDirectionSocks:
+		dial := func(network string, addr string) (net.Conn, error) {
+			if !forward.destinationAllowed(addr) {
+				return nil, errDestinationNotAllowed
+			}
+
+			return sshClient.Dial(network, addr)
+		}
+
+		if forward.Direction == forwardDirectionLocal {
+			return func(_ context.Context, _ net.Conn) (net.Conn, error) {
+				return dial(forward.Remote.network(), forward.Remote.address())
+			}
+		}
+
+		// destination is negotiated per connection
+		return func(_ context.Context, client net.Conn) (net.Conn, error) {
+			return socks5Connect(client, dial)
+		}
+	default:
+		return func(ctx context.Context, client net.Conn) (net.Conn, error) {
+			local, err := dialLocalWithCircuitBreaker(ctx, forward)
+			if err != nil || forward.SendProxyProtocol == "" {
+				return local, err
+			}
+
+			if err := writeProxyProtocolHeader(
+				local,
+				forward.SendProxyProtocol,
+				client.RemoteAddr(),
+				client.LocalAddr(),
+			); err != nil {
+				local.Close()
+				return nil, fmt.Errorf("PROXY protocol header: %s", err.Error())
+			}
+
+			return local, nil
+		}
+	}
+}
+
+func dialLocalWithCircuitBreaker(ctx context.Context, forward Forward) (net.Conn, error) {
+	breaker := forward.circuitBreaker
+	if breaker == nil {
+		return dialLocalWithRetries(ctx, forward)
+	}
+
+	if !breaker.allow() {
+		return nil, errCircuitOpen
+	}
+
+	conn, err := dialLocalWithRetries(ctx, forward)
+	if err != nil && ctx.Err() != nil {
+		breaker.abandon()
+	} else {
+		breaker.result(err)
+	}
+
+	return conn, err
+}
+
+func dialLocalWithRetries(ctx context.Context, forward Forward) (net.Conn, error) {
+	log := newLogger("dialLocal")
+
+	// 0ms, 100ms, 200ms, 400ms, 500ms, ...
+	backoffTime := backoff.ExponentialWithCappedMax(100*time.Millisecond, 500*time.Millisecond)
+
+	dialer := &net.Dialer{
+		Timeout: forward.LocalDialTimeout.Duration, // for each attempt
+	}
+
+	retries := forward.LocalDialRetries
+	if forward.backends != nil && retries < len(forward.backends.backends)-1 {
+		retries = len(forward.backends.backends) - 1 // fail over to each backend at least once
+	}
+
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoffTime()):
+		}
+
+		// with LocalBackends, each attempt picks a backend, so a retry goes to the next one
+		backendIdx, endpoint := 0, forward.Local
+		if forward.backends != nil {
+			backendIdx, endpoint = forward.backends.pick()
+		}
+
+		address := endpoint.address()
+		if forward.LocalResolveFresh && !endpoint.isUnixSocket() {
+			resolved, err := resolveRoundRobin(ctx, forward, endpoint)
+			if err != nil {
+				return nil, err
+			}
+
+			address = resolved
+		}
+
+		conn, err := dialer.DialContext(ctx, forward.localNetworkFor(endpoint), address)
+
+		if forward.backends != nil && ctx.Err() == nil {
+			if err != nil {
+				forward.backends.dialFailed(backendIdx, err)
+			} else {
+				forward.backends.dialSucceeded(backendIdx)
+			}
+		}
+
+		if err == nil || attempt >= retries || ctx.Err() != nil {
+			return conn, err
+		}
+
+		log.Debug(fmt.Sprintf(
+			"%s: %s; retrying (%d/%d)",
+			endpoint.String(),
+			err.Error(),
+			attempt+1,
+			retries))
+	}
+}
+
+// serves connections until ctx is cancelled. if only the listener fails, it is
+// re-established with backoff while the other forwards keep running undisturbed. if the SSH
+// transport died, there's nothing to re-listen on: connectToSshAndServe() reconnects
+func serveForward(
+	ctx context.Context,
+	connectionsCtx context.Context,
+	forward Forward,
+	listener net.Listener,
+	sshClient *ssh.Client,
+	transport *transportWatcher,
+	activeConnections *sync.WaitGroup,
+	state *tunnelState,
+	accessLog *accessLog,
+	connectionHandler ConnectionHandler,
+	channelSlots sshChannelSlots,
+) {
+	log := newLogger("serveForward")
+
+	dialTarget := dialTargetFor(forward, sshClient)
+
+	for {
+		if listener == nil { // died, or initial Listen() failed
+			listener = relistenForward(ctx, forward, sshClient, state)
+			if listener == nil { // cancelled
+				return
+			}
+		}
+
+		state.setListening(forward, listener.Addr())
+		setListeningPortMetric(forward, listener.Addr())
+
+		err := acceptLoop(ctx, connectionsCtx, listener, forward, dialTarget, activeConnections, state, accessLog, connectionHandler, channelSlots)
+		listener = nil
+
+		state.setListening(forward, nil)
+		setListeningPortMetric(forward, nil)
+
+		if remoteListenerClosedByTransport(forward, err) {
+			// transport.dead isn't necessarily closed yet: both follow the connection ending
+			select {
+			case <-ctx.Done():
+			case <-transport.dead:
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-transport.dead:
+			return
+		default:
+		}
+
+		err = fmt.Errorf("Accept(): %s", err.Error())
+
+		state.listenerFailed(forward, err)
+
+		log.Error(fmt.Sprintf("%s: %s; re-listening", forward.listenEndpoint().String(), err.Error()))
+	}
+}
+
+// the SSH library closes remote listeners (= Accept() returns io.EOF) only when we close them
+// or the transport dies
+func remoteListenerClosedByTransport(forward Forward, acceptErr error) bool {
+	return forward.Direction == forwardDirectionReverse && acceptErr == io.EOF
+}
+
+// retries until success. nil if ctx is cancelled
+func relistenForward(ctx context.Context, forward Forward, sshClient *ssh.Client, state *tunnelState) net.Listener {
+	log := newLogger("serveForward")
+
+	backoffTime := backoff.ExponentialWithCappedMax(100*time.Millisecond, 5*time.Second)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoffTime()):
+		}
+
+		listener, err := listenForForward(forward, sshClient)
+		if err == nil {
+			return listener
+		}
+
+		state.listenerFailed(forward, err)
+
+		log.Error(fmt.Sprintf("%s: re-listen: %s", forward.listenEndpoint().String(), err.Error()))
+	}
+}
+
+// returns Accept()'s error. cancelling ctx closes the listener, which fails Accept().
+// accepted connections are closed when connectionsCtx is cancelled
+func acceptLoop(
+	ctx context.Context,
+	connectionsCtx context.Context,
+	listener net.Listener,
+	forward Forward,
+	dialTarget dialTargetFn,
+	activeConnections *sync.WaitGroup,
+	state *tunnelState,
+	accessLog *accessLog,
+	connectionHandler ConnectionHandler,
+	channelSlots sshChannelSlots,
+) error {
+	defer listener.Close()
+
+	// local listeners are not closed for us with the SSH connection, and when shutting down
+	// we need to stop accepting even though the SSH connection is still up
+	acceptLoopDone := make(chan struct{})
+	defer close(acceptLoopDone)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-acceptLoopDone:
+		}
+	}()
+
+	bytesTransferred := state.bytesCounter(forward)
+
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		activeConnections.Add(1)
+		state.addActiveConnections(forward, 1)
+
+		go func() {
+			defer activeConnections.Done()
+			defer state.addActiveConnections(forward, -1)
+
+			handleClient(connectionsCtx, client, forward, dialTarget, bytesTransferred, accessLog, connectionHandler, channelSlots)
+		}()
+	}
+}
+
+// waits for in-flight connections to finish, but at most for gracePeriod
+func drainConnections(activeConnections *sync.WaitGroup, gracePeriod time.Duration) {
+	log := newLogger("drainConnections")
+
+	drained := make(chan struct{})
+
+	go func() {
+		activeConnections.Wait()
+		close(drained)
+	}()
+
+	log.Info(fmt.Sprintf("waiting up to %s for active connections to finish", gracePeriod))
+
+	select {
+	case <-drained:
+	case <-time.After(gracePeriod):
+		log.Error("grace period exceeded; force-closing remaining connections")
+	}
+}
+
+// after closing connections on teardown, so that none of them outlives its SSH connection.
+// closed connections finish promptly, so the limit is only for a ConnectionHandler stuck
+// in code of its own
+func waitForClosedConnections(activeConnections *sync.WaitGroup) {
+	closed := make(chan struct{})
+
+	go func() {
+		activeConnections.Wait()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		newLogger("waitForClosedConnections").Warn("connections still running after being closed")
+	}
+}
+
+// one config file's forwards, with its own SSH connection and reconnect loop
+type tunnel struct {
+	configFile        string         // "" if config wasn't read from a file
+	conf              *Configuration // as of startup. reloads only change forwards
+	forwards          *forwardSet
+	state             *tunnelState
+	notifier          *webhookNotifier // nil if not configured
+	hooks             *hookRunner      // nil if not configured
+	accessLog         *accessLog       // nil if not configured
+	connectionHandler ConnectionHandler
+	reloadMu          sync.Mutex // reload can be triggered by both Client.Reload() and control socket
+}
+
+// returns nil when ctx is cancelled
+func runTunnel(ctx context.Context, client *Client) error {
+	log := newLogger("runTunnel")
+
+	conf := client.conf
+
+	configName := client.configFile
+	if configName == "" {
+		configName = "config"
+	}
+
+	forwards := expandPortRanges(EnabledForwards(conf.Forwards))
+
+	if len(forwards) == 0 {
+		if !conf.AllowNoForwards {
+			return fmt.Errorf("%s: %s", configName, errNoForwards.Error())
+		}
+
+		log.Warn(fmt.Sprintf("%s: no forwards; only connecting (allow_no_forwards)", configName))
+	}
+
+	servers, err := resolveSshServers(conf.SshServers)
+	if err != nil {
+		return err
+	}
+
+	backoffTime := reconnectBackoff(conf.Reconnect)
+	dnsBackoffTime := dnsRetryBackoff()
+
+	accessLog, err := newAccessLog(conf)
+	if err != nil {
+		return err
+	}
+	defer accessLog.close()
+
+	connectionHandler := client.ConnectionHandler
+	if connectionHandler == nil {
+		connectionHandler = DefaultConnectionHandler
+	}
+
+	if conf.MetricsListenAddr != "" {
+		go serveMetrics(conf.MetricsListenAddr)
+	}
+
+	tun := &tunnel{
+		configFile:        client.configFile,
+		conf:              conf,
+		forwards:          newForwardSet(forwards),
+		state:             newTunnelState(forwards),
+		notifier:          newWebhookNotifier(conf.Notifications),
+		hooks:             newHookRunner(conf.Hooks),
+		accessLog:         accessLog,
+		connectionHandler: connectionHandler,
+	}
+	defer tun.notifier.waitForDeliveries()
+	defer tun.hooks.waitForHooks()
+
+	client.setRunning(tun)
+	defer client.setRunning(nil)
+
+	if conf.ControlSocketPath != "" {
+		go serveControl(ctx, conf.ControlSocketPath, tun)
+	}
+
+	if conf.HealthListenAddr != "" {
+		go serveHealth(conf.HealthListenAddr, tun.state)
+	}
+
+	if conf.DebugListenAddr != "" {
+		defer debugVars.register(configName, tun.state)()
+
+		go serveDebugVars(conf.DebugListenAddr)
+	}
+
+	// servers are tried in order. backoff only applies after all of them have failed
+	serverIdx := 0
+
+	failedAttempts := 0
+
+	roundFailedOnDns := true // all servers tried since last backoff failed resolving their name
+
+	for {
+		attemptStarted := time.Now()
+
+		err := connectToSshAndServe(ctx, tun, servers[serverIdx])
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		if err == errMaxConnectionLifetime && !client.Once { // planned, so same server and no backoff
+			log.Info(fmt.Sprintf("%s: reconnecting", servers[serverIdx].Address))
+			tun.notifier.notify(eventDisconnected, servers[serverIdx].Address, err)
+			failedAttempts = 0
+			backoffTime = reconnectBackoff(conf.Reconnect)
+			metrics.reconnects.Inc()
+			tun.state.countReconnect()
+			continue
+		}
+
+		if isNameResolutionError(err) {
+			log.Warn(fmt.Sprintf("%s: waiting for network/DNS: %s", servers[serverIdx].Address, err.Error()))
+		} else {
+			log.Error(fmt.Sprintf("%s: %s", servers[serverIdx].Address, err.Error()))
+
+			roundFailedOnDns = false
+			dnsBackoffTime = dnsRetryBackoff()
+		}
+
+		if _, failedToConnect := err.(*connectError); failedToConnect {
+			failedAttempts++
+			tun.notifier.notify(eventConnectFailed, servers[serverIdx].Address, err)
+		} else {
+			failedAttempts = 0
+
+			// a blip on an otherwise stable link (or server restart) shouldn't be slowed down
+			// by backoff from earlier failures. but a connection that dies right away (like
+			// server accepting and then kicking us out) keeps backing off
+			if time.Since(attemptStarted) >= stableConnectionDuration {
+				backoffTime = reconnectBackoff(conf.Reconnect)
+			}
+			tun.notifier.notify(eventDisconnected, servers[serverIdx].Address, err)
+		}
+
+		if client.Once {
+			return ErrNotReconnecting
+		}
+
+		if conf.Reconnect.MaxAttempts > 0 && failedAttempts >= conf.Reconnect.MaxAttempts {
+			return fmt.Errorf("giving up after %d failed connection attempts in a row", failedAttempts)
+		}
+
+		if _, failedToConnect := err.(*connectError); failedToConnect {
+			serverIdx = (serverIdx + 1) % len(servers)
+		} else {
+			// session was established (even if on a secondary): start over from the primary
+			serverIdx = 0
+		}
+
+		if serverIdx == 0 {
+			wait := backoffTime
+			if roundFailedOnDns {
+				wait = dnsBackoffTime
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(wait()):
+			}
+
+			roundFailedOnDns = true
+		}
+
+		metrics.reconnects.Inc()
+		tun.state.countReconnect()
+	}
+}
+
+func connectSshRegularTcp(
+	ctx context.Context,
+	server SshServer,
+	sshConfig *ssh.ClientConfig,
+) (*ssh.Client, *handshakeDetails, error) {
+	addr := server.Address
+
+	conn, err := dialSshServer(ctx, server, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return sshClientForConn(conn, addr, sshConfig)
+}
+
+// TCP connection to addr, through proxy if one is configured
+func dialSshServer(ctx context.Context, server SshServer, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:       server.ConnectTimeout.Duration,
+		KeepAlive:     dialerKeepAlive(server),
+		FallbackDelay: happyEyeballsFallbackDelay,
+	}
+
+	proxyUrl, err := proxyUrlFor(server, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyUrl != nil {
+		return dialThroughProxy(ctx, proxyUrl, dialer, addr)
+	}
+
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// for net.Dialer, where zero would mean Go's default and negative disables
+func dialerKeepAlive(server SshServer) time.Duration {
+	if server.TcpKeepaliveInterval == nil { // defaults not applied
+		return tcpkeepalive.DefaultDuration
+	}
+
+	if server.TcpKeepaliveInterval.Duration == 0 {
+		return -1
+	}
+
+	return server.TcpKeepaliveInterval.Duration
+}
+
+// RFC 6555 (happy eyeballs): if a hostname has both AAAA and A records and the IPv6 attempt
+// hasn't succeeded by then, IPv4 is raced alongside it. a broken IPv6 path then costs us
+// this much instead of the whole connect timeout
+const happyEyeballsFallbackDelay = 300 * time.Millisecond
+
+func sshClientForConn(
+	conn net.Conn,
+	addr string,
+	sshConfig *ssh.ClientConfig,
+) (*ssh.Client, *handshakeDetails, error) {
+	sniffer := &kexInitSniffer{Conn: conn}
+
+	// record the host key the server presented
+	var hostKey ssh.PublicKey
+	sshConfigCopy := *sshConfig
+	sshConfigCopy.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		hostKey = key
+		return sshConfig.HostKeyCallback(hostname, remote, key)
+	}
+
+	handshakeConfig := &sshConfigCopy
+
+	var trace *sshHandshakeTrace
+	if sshTraceEnabled {
+		sshTrace(fmt.Sprintf("%s: starting SSH handshake as user %s", addr, sshConfig.User))
+
+		handshakeConfig, trace = traceClientConfig(addr, &sshConfigCopy)
+	}
+
+	sconn, chans, reqs, err := ssh.NewClientConn(sniffer, addr, handshakeConfig)
+	if err != nil {
+		if trace != nil {
+			trace.failed(sniffer.serverKexInit(), sshConfig.Config, err)
+		}
+
+		return nil, nil, err
+	}
+
+	details := describeHandshake(sconn, sniffer.serverKexInit(), sshConfig.Config, hostKey)
+
+	if sshTraceEnabled {
+		sshTrace(fmt.Sprintf("%s: authenticated as %s (%s)", addr, sconn.User(), details.String()))
+
+		reqs = traceGlobalRequests(addr, reqs)
+	}
+
+	return ssh.NewClient(sconn, chans, reqs), details, nil
+}
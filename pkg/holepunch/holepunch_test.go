@@ -0,0 +1,509 @@
+package holepunch
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// only a forward's own listener failing must not take down the SSH connection or other forwards
+func TestForwardRelistensAfterListenerFails(t *testing.T) {
+	server := startTestSshServer(t)
+	echo := startEchoServer(t)
+
+	// the local forward's listener is handed over like one from systemd, for making it fail
+	localListener := newFailingListener(t)
+	useActivatedListenerForTest(t, localListener)
+
+	tun, serveResult := serveViaTestSshServer(t, server, fmt.Sprintf(`[
+		{ "direction": "local", "local": { "host": "127.0.0.1", "port": %d }, "remote": { "host": "127.0.0.1", "port": %d } },
+		{ "local": { "host": "127.0.0.1", "port": %d }, "remote": { "host": "127.0.0.1", "port": 0 } }
+	]`, portOf(localListener.Addr()), portOf(echo.Addr()), portOf(echo.Addr())))
+
+	waitForForwards(t, tun, func(forwards []ForwardState) bool {
+		return forwards[0].Listening && forwards[1].Listening
+	})
+
+	localListener.fail <- errors.New("accept: too many open files")
+
+	waitForForwards(t, tun, func(forwards []ForwardState) bool {
+		return forwards[0].ListenerErrors == 1 && forwards[0].Listening
+	})
+
+	expectEcho(t, localListener.Addr().String())
+
+	// other forward wasn't disturbed
+	forwards := tun.state.snapshot().Forwards
+	if forwards[1].ListenerErrors != 0 {
+		t.Errorf("other forward had listener errors: %s", forwards[1].LastListenerError)
+	}
+
+	expectEcho(t, forwards[1].ListeningAddr)
+
+	select {
+	case err := <-serveResult:
+		t.Fatalf("connectToSshAndServe() returned: %v", err)
+	default:
+	}
+}
+
+// connections in flight when the SSH connection dies must not keep teardown (and so
+// reconnecting) waiting
+func TestTeardownWaitsForForwardsAndConnections(t *testing.T) {
+	server := startTestSshServer(t)
+	echo := startEchoServer(t)
+
+	// nothing listens here, so connections to the second forward keep retrying the dial
+	refusing := listenForTest(t)
+	refusing.Close()
+
+	// not both port 0, since forwards are told apart by their remote address
+	tun, serveResult := serveViaTestSshServer(t, server, fmt.Sprintf(`[
+		{ "local": { "host": "127.0.0.1", "port": %d }, "remote": { "host": "127.0.0.1", "port": %d } },
+		{ "local": { "host": "127.0.0.1", "port": %d }, "remote": { "host": "127.0.0.1", "port": %d }, "local_dial_retries": 1000 }
+	]`, portOf(echo.Addr()), freePortForTest(t), portOf(refusing.Addr()), freePortForTest(t)))
+
+	waitForForwards(t, tun, func(forwards []ForwardState) bool {
+		return forwards[0].Listening && forwards[1].Listening
+	})
+
+	forwards := tun.state.snapshot().Forwards
+
+	// idle but open, so its pipe is blocked reading from both ends
+	expectEcho(t, forwards[0].ListeningAddr)
+
+	dialing, err := net.Dial("tcp", forwards[1].ListeningAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialing.Close()
+
+	waitForForwards(t, tun, func(forwards []ForwardState) bool {
+		return forwards[0].ActiveConnections == 1 && forwards[1].ActiveConnections == 1
+	})
+
+	server.closeConnections()
+
+	// connectToSshAndServe() waits for serveForward()s to return and then for activeConnections,
+	// giving up on the latter after 5 seconds. returning sooner means it drained
+	select {
+	case err := <-serveResult:
+		if err == nil {
+			t.Error("expected error for SSH connection closing")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("connectToSshAndServe() didn't return after SSH server closed the connection")
+	}
+
+	for _, forward := range tun.state.snapshot().Forwards {
+		if forward.ActiveConnections != 0 {
+			t.Errorf("%s: %d connections still active", forward.Forward, forward.ActiveConnections)
+		}
+	}
+}
+
+// SSH server that accepts the test client's key, and does remote (tcpip-forward) and local
+// (direct-tcpip) forwarding
+type testSshServer struct {
+	listener  net.Listener
+	hostKey   ssh.Signer
+	clientKey []byte // PEM
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startTestSshServer(t *testing.T) *testSshServer {
+	t.Helper()
+
+	_, hostPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostKey, err := ssh.NewSignerFromKey(hostPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKey := generateEd25519Pem(t)
+
+	clientSigner, err := parsePrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientSigner.PublicKey().Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+
+			return nil, nil
+		},
+	}
+	serverConfig.AddHostKey(hostKey)
+
+	server := &testSshServer{
+		listener:  listenForTest(t),
+		hostKey:   hostKey,
+		clientKey: clientKey,
+	}
+
+	go func() {
+		for {
+			conn, err := server.listener.Accept()
+			if err != nil {
+				return
+			}
+
+			server.mu.Lock()
+			server.conns = append(server.conns, conn)
+			server.mu.Unlock()
+
+			go server.serve(conn, serverConfig)
+		}
+	}()
+
+	t.Cleanup(server.closeConnections)
+
+	return server
+}
+
+// server side going away, like sshd being restarted
+func (s *testSshServer) closeConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *testSshServer) serve(conn net.Conn, serverConfig *ssh.ServerConfig) {
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, serverConfig)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	forwardListeners := &sync.Map{}
+	defer forwardListeners.Range(func(_ interface{}, listener interface{}) bool {
+		listener.(net.Listener).Close()
+		return true
+	})
+
+	go s.handleGlobalRequests(sshConn, requests, forwardListeners)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, newChannel.ChannelType())
+			continue
+		}
+
+		go handleDirectTcpip(newChannel)
+	}
+}
+
+// RFC 4254 7.1
+type tcpipForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// RFC 4254 7.2 (also used for direct-tcpip)
+type forwardedTcpipPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+func (s *testSshServer) handleGlobalRequests(sshConn *ssh.ServerConn, requests <-chan *ssh.Request, forwardListeners *sync.Map) {
+	for req := range requests {
+		forward := tcpipForwardRequest{}
+		if err := ssh.Unmarshal(req.Payload, &forward); err != nil {
+			_ = req.Reply(false, nil)
+			continue
+		}
+
+		bindAddr := net.JoinHostPort(forward.BindAddr, strconv.Itoa(int(forward.BindPort)))
+
+		switch req.Type {
+		case "tcpip-forward":
+			listener, err := net.Listen("tcp", bindAddr)
+			if err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+
+			port := uint32(portOf(listener.Addr()))
+
+			forwardListeners.Store(net.JoinHostPort(forward.BindAddr, strconv.Itoa(int(port))), listener)
+
+			_ = req.Reply(true, ssh.Marshal(struct{ Port uint32 }{port}))
+
+			go forwardToClient(sshConn, listener, forward.BindAddr, port)
+		case "cancel-tcpip-forward":
+			if listener, found := forwardListeners.LoadAndDelete(bindAddr); found {
+				listener.(net.Listener).Close()
+			}
+
+			_ = req.Reply(true, nil)
+		default:
+			_ = req.Reply(false, nil)
+		}
+	}
+}
+
+func forwardToClient(sshConn *ssh.ServerConn, listener net.Listener, bindAddr string, port uint32) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		origin := conn.RemoteAddr().(*net.TCPAddr)
+
+		channel, requests, err := sshConn.OpenChannel("forwarded-tcpip", ssh.Marshal(forwardedTcpipPayload{
+			Addr:       bindAddr,
+			Port:       port,
+			OriginAddr: origin.IP.String(),
+			OriginPort: uint32(origin.Port),
+		}))
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+
+		go pipeForTest(conn, channel)
+	}
+}
+
+func handleDirectTcpip(newChannel ssh.NewChannel) {
+	target := forwardedTcpipPayload{}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Addr, strconv.Itoa(int(target.Port))))
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	pipeForTest(conn, channel)
+}
+
+func pipeForTest(a io.ReadWriteCloser, b io.ReadWriteCloser) {
+	defer a.Close()
+	defer b.Close()
+
+	go func() {
+		_, _ = io.Copy(a, b)
+		a.Close()
+	}()
+
+	_, _ = io.Copy(b, a)
+}
+
+// runs connectToSshAndServe() with forwards (a JSON array) until the test ends
+func serveViaTestSshServer(t *testing.T, server *testSshServer, forwardsJson string) (*tunnel, <-chan error) {
+	t.Helper()
+
+	conf := readTestConfig(t, "holepunch.json", fmt.Sprintf(`{
+		"ssh_servers": [{
+			"address": %q,
+			"username": "test",
+			"private_key_file_path": %q,
+			"host_public_key": %q,
+			"keepalive_interval": "1m"
+		}],
+		"forwards": %s,
+		"shutdown_grace_period": "1s"
+	}`,
+		server.listener.Addr().String(),
+		writeTestFile(t, "id_ed25519", string(server.clientKey)),
+		string(ssh.MarshalAuthorizedKey(server.hostKey.PublicKey())),
+		forwardsJson))
+
+	resolved, err := resolveSshServer(conf.SshServers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forwards := expandPortRanges(EnabledForwards(conf.Forwards))
+
+	tun := &tunnel{
+		conf:              conf,
+		forwards:          newForwardSet(forwards),
+		state:             newTunnelState(forwards),
+		connectionHandler: DefaultConnectionHandler,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	serveResult := make(chan error, 1)
+	served := make(chan struct{}) // serveResult can be consumed by the test
+	go func() {
+		defer close(served)
+		serveResult <- connectToSshAndServe(ctx, tun, resolved)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-served
+	})
+
+	return tun, serveResult
+}
+
+func waitForForwards(t *testing.T, tun *tunnel, condition func(forwards []ForwardState) bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !condition(tun.state.snapshot().Forwards) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out; forwards: %+v", tun.state.snapshot().Forwards)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func startEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+
+	listener := listenForTest(t)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener
+}
+
+// connects to addr and expects what it sends to come back
+func expectEcho(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("%s: %s", addr, err.Error())
+	}
+
+	if reply != "ping\n" {
+		t.Fatalf("%s: unexpected reply %q", addr, reply)
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn
+}
+
+// Accept() returns what's sent to fail, otherwise connections to the real listener
+type failingListener struct {
+	net.Listener
+	accepted chan net.Conn
+	fail     chan error
+}
+
+func newFailingListener(t *testing.T) *failingListener {
+	listener := &failingListener{
+		Listener: listenForTest(t),
+		accepted: make(chan net.Conn),
+		fail:     make(chan error),
+	}
+
+	go func() {
+		defer close(listener.accepted)
+
+		for {
+			conn, err := listener.Listener.Accept()
+			if err != nil {
+				return
+			}
+
+			listener.accepted <- conn
+		}
+	}()
+
+	return listener
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	select {
+	case conn, ok := <-l.accepted:
+		if !ok {
+			return nil, net.ErrClosed
+		}
+
+		return conn, nil
+	case err := <-l.fail:
+		return nil, err
+	}
+}
+
+// as if systemd had passed listener
+func useActivatedListenerForTest(t *testing.T, listener net.Listener) {
+	activatedListeners.once.Do(func() {}) // don't look for real ones
+	activatedListeners.listeners = []*activatedListener{
+		{listener: listener, accepted: make(chan acceptResult)},
+	}
+
+	t.Cleanup(func() { activatedListeners.listeners = nil })
+}
+
+// closed again, so this can race with something else grabbing the port
+func freePortForTest(t *testing.T) int {
+	listener := listenForTest(t)
+	defer listener.Close()
+
+	return portOf(listener.Addr())
+}
+
+func portOf(addr net.Addr) int {
+	return addr.(*net.TCPAddr).Port
+}
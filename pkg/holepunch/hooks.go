@@ -0,0 +1,131 @@
+package holepunch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// a hung hook is killed after this
+const hookTimeout = 1 * time.Minute
+
+type hookRun struct {
+	event    string
+	command  string
+	server   string
+	forwards []Forward
+}
+
+// nil runner is usable, and does nothing. hooks are run one at a time in the order of events,
+// so that a disconnect hook never races the connect hook before it
+type hookRunner struct {
+	hooks Hooks
+	queue chan hookRun
+	done  chan struct{}
+}
+
+func newHookRunner(hooks Hooks) *hookRunner {
+	if hooks.OnConnect == "" && hooks.OnDisconnect == "" {
+		return nil
+	}
+
+	h := &hookRunner{
+		hooks: hooks,
+		queue: make(chan hookRun, 16),
+		done:  make(chan struct{}),
+	}
+
+	go h.worker()
+
+	return h
+}
+
+// doesn't block
+func (h *hookRunner) run(event string, server string, forwards []Forward) {
+	if h == nil {
+		return
+	}
+
+	command := h.hooks.OnConnect
+	if event == eventDisconnected {
+		command = h.hooks.OnDisconnect
+	}
+
+	if command == "" {
+		return
+	}
+
+	select {
+	case h.queue <- hookRun{event, command, server, forwards}:
+	default:
+		newLogger("hookRunner").Warn(fmt.Sprintf("too many hooks queued; skipping %s hook", event))
+	}
+}
+
+// lets queued hooks finish before exiting. no more hooks can be run after this
+func (h *hookRunner) waitForHooks() {
+	if h == nil {
+		return
+	}
+
+	close(h.queue)
+	<-h.done
+}
+
+func (h *hookRunner) worker() {
+	defer close(h.done)
+
+	log := newLogger("hookRunner")
+
+	for run := range h.queue {
+		output, err := runHook(run)
+		if trimmed := strings.TrimSpace(string(output)); trimmed != "" {
+			for _, line := range strings.Split(trimmed, "\n") {
+				log.Info(fmt.Sprintf("%s hook: %s", run.event, line))
+			}
+		}
+
+		if err != nil {
+			log.Error(fmt.Sprintf("%s hook failed: %s", run.event, err.Error()))
+		}
+	}
+}
+
+// details are passed in ENV. HOLEPUNCH_FORWARDS is JSON in the same format as
+// "holepunch forwards --json"
+func runHook(run hookRun) ([]byte, error) {
+	summaries := []ForwardSummary{}
+	for _, forward := range run.forwards {
+		summaries = append(summaries, SummarizeForward(forward))
+	}
+
+	forwardsJson, err := json.Marshal(summaries)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	cmd := shellCommand(ctx, run.command)
+	cmd.Env = append(
+		os.Environ(),
+		"HOLEPUNCH_EVENT="+run.event,
+		"HOLEPUNCH_SERVER="+run.server,
+		"HOLEPUNCH_FORWARDS="+string(forwardsJson))
+
+	return cmd.CombinedOutput()
+}
+
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
@@ -0,0 +1,202 @@
+package holepunch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// host key verification is mandatory unless explicitly opted out of
+func hostKeyCallbackFromConfig(server SshServer) (ssh.HostKeyCallback, error) {
+	if server.InsecureSkipHostKeyVerification {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	if pinned := pinnedHostKeyLines(server); len(pinned) > 0 {
+		pinnedKeys, err := parsePinnedHostKeys(pinned)
+		if err != nil {
+			return nil, err
+		}
+
+		return pinnedHostKeyCallback(pinnedKeys), nil
+	}
+
+	if server.KnownHostsFilePath == "" {
+		return nil, errors.New("Host key verification not configured: specify known_hosts_file_path or host_public_key (or insecure_skip_host_key_verification if you know what you're doing)")
+	}
+
+	if server.HostKeyTrustOnFirstUse {
+		return trustOnFirstUseHostKeyCallback(server.KnownHostsFilePath), nil
+	}
+
+	knownHostsCallback, err := knownhosts.New(server.KnownHostsFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read known_hosts file %s: %s", server.KnownHostsFilePath, err.Error())
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if err := knownHostsCallback(hostname, remote, key); err != nil {
+			return describeHostKeyError(err, hostname, key, server.KnownHostsFilePath)
+		}
+
+		return nil
+	}, nil
+}
+
+// HostPublicKey, then HostPublicKeys
+func pinnedHostKeyLines(server SshServer) []string {
+	lines := []string{}
+	if server.HostPublicKey != "" {
+		lines = append(lines, server.HostPublicKey)
+	}
+
+	return append(lines, server.HostPublicKeys...)
+}
+
+func parsePinnedHostKeys(lines []string) ([]ssh.PublicKey, error) {
+	keys := []ssh.PublicKey{}
+
+	for _, line := range lines {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid host_public_key %q: %s", line, err.Error())
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// accepts only the pinned keys, regardless of hostname
+func pinnedHostKeyCallback(pinned []ssh.PublicKey) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		presented := key.Marshal()
+
+		expected := []string{}
+		for _, pinnedKey := range pinned {
+			if bytes.Equal(presented, pinnedKey.Marshal()) {
+				return nil
+			}
+
+			expected = append(expected, pinnedKey.Type()+" "+ssh.FingerprintSHA256(pinnedKey))
+		}
+
+		return fmt.Errorf(
+			"HOST KEY MISMATCH for %s (possible MITM attack): presented %s key %s, expected host_public_key %s",
+			hostname,
+			key.Type(),
+			ssh.FingerprintSHA256(key),
+			strings.Join(expected, " or "))
+	}
+}
+
+// records the host key if we've never seen the host before. known_hosts is re-read on each
+// connect so that the key we recorded on first use gets enforced on subsequent connects.
+// a changed key is never updated automatically.
+func trustOnFirstUseHostKeyCallback(knownHostsFile string) ssh.HostKeyCallback {
+	log := newLogger("trustOnFirstUse")
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		knownHostsCallback, err := knownhosts.New(knownHostsFile)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Cannot read known_hosts file %s: %s", knownHostsFile, err.Error())
+		}
+
+		if err == nil { // file exists
+			err := knownHostsCallback(hostname, remote, key)
+			if err == nil {
+				return nil // known host, matching key
+			}
+
+			// mismatch must fail hard. only an unknown host falls through to being recorded
+			if keyErr, is := err.(*knownhosts.KeyError); !is || len(keyErr.Want) > 0 {
+				return describeHostKeyError(err, hostname, key, knownHostsFile)
+			}
+		}
+
+		log.Info(fmt.Sprintf(
+			"first connect to %s; trusting %s key %s and recording it to %s",
+			hostname,
+			key.Type(),
+			ssh.FingerprintSHA256(key),
+			knownHostsFile))
+
+		return appendToFileAtomically(knownHostsFile, knownhosts.Line([]string{hostname}, key)+"\n")
+	}
+}
+
+// knownhosts errors don't tell which host or key was offending
+func describeHostKeyError(err error, hostname string, key ssh.PublicKey, knownHostsFile string) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	switch err := err.(type) {
+	case *knownhosts.KeyError:
+		if len(err.Want) == 0 {
+			return fmt.Errorf(
+				"host %s not found from %s (presented %s key %s)",
+				hostname,
+				knownHostsFile,
+				key.Type(),
+				fingerprint)
+		}
+
+		return fmt.Errorf(
+			"HOST KEY MISMATCH for %s (possible MITM attack): presented %s key %s, expected %s",
+			hostname,
+			key.Type(),
+			fingerprint,
+			err.Want[0].String())
+	case *knownhosts.RevokedError:
+		return fmt.Errorf("host %s presented revoked key %s (%s)", hostname, fingerprint, err.Revoked.String())
+	default:
+		return fmt.Errorf("host key verification for %s (key %s): %s", hostname, fingerprint, err.Error())
+	}
+}
+
+// writes previous content + addition to a temp file in the same directory and renames it
+// over the original, so readers never observe a partially written file
+func appendToFileAtomically(path string, addition string) error {
+	previous, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if len(previous) > 0 && previous[len(previous)-1] != '\n' {
+		previous = append(previous, '\n')
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name()) // no-op after successful rename
+
+	if _, err := tempFile.Write(append(previous, addition...)); err != nil {
+		tempFile.Close()
+		return err
+	}
+
+	if err := tempFile.Chmod(0644); err != nil {
+		tempFile.Close()
+		return err
+	}
+
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return err
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), path)
+}
@@ -0,0 +1,88 @@
+package holepunch
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// closes both conns if no bytes flow in either direction for the timeout duration. SSH
+// channels don't support deadlines, so instead of SetDeadline() we track last activity and
+// a watchdog closes the conns, which makes the pipe return
+type idleWatchdog struct {
+	lastActivity int64 // UnixNano. first in struct for 64-bit alignment of atomic ops
+	timedOut     int32
+	stop         chan struct{}
+}
+
+// returns wrapped conns which must be used for piping, so activity is noticed
+func withIdleTimeout(client net.Conn, remote net.Conn, timeout time.Duration) (net.Conn, net.Conn, *idleWatchdog) {
+	watchdog := &idleWatchdog{
+		lastActivity: time.Now().UnixNano(),
+		stop:         make(chan struct{}),
+	}
+
+	go watchdog.run(timeout, client, remote)
+
+	return &activityConn{client, watchdog}, &activityConn{remote, watchdog}, watchdog
+}
+
+func (w *idleWatchdog) run(timeout time.Duration, conns ...net.Conn) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-timer.C:
+			idleFor := time.Since(time.Unix(0, atomic.LoadInt64(&w.lastActivity)))
+			if idleFor < timeout {
+				timer.Reset(timeout - idleFor)
+				continue
+			}
+
+			atomic.StoreInt32(&w.timedOut, 1)
+
+			for _, conn := range conns {
+				conn.Close()
+			}
+
+			return
+		}
+	}
+}
+
+func (w *idleWatchdog) touch() {
+	atomic.StoreInt64(&w.lastActivity, time.Now().UnixNano())
+}
+
+// whether the conns were closed by us
+func (w *idleWatchdog) hasTimedOut() bool {
+	return atomic.LoadInt32(&w.timedOut) == 1
+}
+
+func (w *idleWatchdog) stopWatching() {
+	close(w.stop)
+}
+
+type activityConn struct {
+	net.Conn
+	watchdog *idleWatchdog
+}
+
+func (a *activityConn) Read(b []byte) (int, error) {
+	n, err := a.Conn.Read(b)
+	if n > 0 {
+		a.watchdog.touch()
+	}
+	return n, err
+}
+
+func (a *activityConn) Write(b []byte) (int, error) {
+	n, err := a.Conn.Write(b)
+	if n > 0 {
+		a.watchdog.touch()
+	}
+	return n, err
+}
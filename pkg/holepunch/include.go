@@ -0,0 +1,166 @@
+package holepunch
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// contents of a file matched by ForwardsInclude
+type forwardsFile struct {
+	Forwards []Forward `json:"forwards" yaml:"forwards"`
+}
+
+// appends forwards from files matched by conf.ForwardsInclude (relative to the config file's
+// directory), in order of the patterns and then file names. a pattern without wildcards must
+// match a file, but a glob matching nothing is fine (like an empty drop-in directory). returns
+// each forward's source file for checkDuplicateRemotes(), which is left to the caller so that
+// it can be done after ENV expansion
+func includeForwards(conf *Configuration, configPath string) ([]string, error) {
+	// for telling where a forward came from in errors
+	sources := make([]string, len(conf.Forwards))
+	for i := range sources {
+		sources[i] = configPath
+	}
+
+	included := map[string]bool{filepath.Clean(configPath): true}
+
+	for _, pattern := range includePatterns(conf, configPath) {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("forwards_include %s: %s", pattern, err.Error())
+		}
+
+		if len(matches) == 0 && !hasGlobWildcards(pattern) {
+			return nil, fmt.Errorf("forwards_include %s: file not found", pattern)
+		}
+
+		for _, match := range matches {
+			if included[match] { // matched by an earlier pattern too
+				continue
+			}
+			included[match] = true
+
+			forwards, err := readForwardsFile(match)
+			if err != nil {
+				return nil, err
+			}
+
+			for range forwards {
+				sources = append(sources, match)
+			}
+
+			conf.Forwards = append(conf.Forwards, forwards...)
+		}
+	}
+
+	return sources, nil
+}
+
+// conf.ForwardsInclude with relative patterns resolved against the config file's directory
+func includePatterns(conf *Configuration, configPath string) []string {
+	patterns := []string{}
+
+	for _, pattern := range conf.ForwardsInclude {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(configPath), pattern)
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns
+}
+
+func hasGlobWildcards(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// the config file and its forwards_include patterns, for watching them for changes. reads
+// only as much of the config as needed for that, so it works even if the config is invalid
+// otherwise
+func ConfigFilePatterns(configPath string) ([]string, error) {
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	yamlFormat := isYamlConfigFile(configPath)
+
+	migrated, _, err := migrateConfig(content, yamlFormat)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", configPath, err.Error())
+	}
+
+	if migrated != nil {
+		content = migrated
+	}
+
+	conf := &Configuration{}
+	if err := decodeStrict(content, yamlFormat, conf); err != nil {
+		return nil, fmt.Errorf("%s: %s", configPath, err.Error())
+	}
+
+	return append([]string{configPath}, includePatterns(conf, configPath)...), nil
+}
+
+func readForwardsFile(path string) ([]Forward, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &forwardsFile{}
+	if err := decodeStrict(content, isYamlConfigFile(path), file); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	return file.Forwards, nil
+}
+
+// two reverse forwards binding the same remote address is a mistake that would otherwise only
+// show up as a Listen() failure after connecting. easy to make when forwards are spread over
+// many files. disabled forwards don't bind anything, and many can have a server-assigned port
+func checkDuplicateRemotes(forwards []Forward, sources []string) error {
+	boundBy := map[string]int{}
+
+	for i, forward := range forwards {
+		// Direction default is applied later
+		if forward.Disabled || (forward.Direction != "" && forward.Direction != forwardDirectionReverse) {
+			continue
+		}
+
+		if !forward.Remote.isUnixSocket() && forward.Remote.Port == 0 {
+			continue
+		}
+
+		portCount := forward.PortCount
+		if portCount < 1 || forward.Remote.isUnixSocket() {
+			portCount = 1
+		}
+
+		for n := 0; n < portCount; n++ {
+			remote := forward.Remote
+			if !remote.isUnixSocket() {
+				remote.Port += n
+			}
+
+			key := remote.String()
+
+			if previous, duplicate := boundBy[key]; duplicate {
+				return fmt.Errorf(
+					"Duplicate remote %s: forwards[%d] (%s) and forwards[%d] (%s)",
+					key,
+					previous,
+					sources[previous],
+					i,
+					sources[i])
+			}
+
+			boundBy[key] = i
+		}
+	}
+
+	return nil
+}
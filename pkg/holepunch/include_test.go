@@ -0,0 +1,98 @@
+package holepunch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const includingConfig = `{
+	"ssh_servers": [{ "address": "ssh.example.com:22", "username": "tunnel", "private_key": "key" }],
+	"forwards_include": ["forwards.d/*.json"],
+	"forwards": [{ "local": { "port": 8080 }, "remote": { "host": "${HOLEPUNCH_TEST_BIND_A}", "port": 80 } }]
+}`
+
+func TestIncludedForwardsAreAppended(t *testing.T) {
+	t.Setenv("HOLEPUNCH_TEST_BIND_A", "127.0.0.1")
+
+	configPath := writeIncludeTestFiles(t, map[string]string{
+		"holepunch.json":    includingConfig,
+		"forwards.d/b.json": `{"forwards": [{ "local": { "port": 8082 }, "remote": { "host": "127.0.0.1", "port": 82 } }]}`,
+		"forwards.d/a.json": `{"forwards": [{ "local": { "port": 8081 }, "remote": { "host": "127.0.0.1", "port": 81 } }]}`,
+	})
+
+	conf, err := ReadConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ports := []int{}
+	for _, forward := range conf.Forwards {
+		ports = append(ports, forward.Remote.Port)
+	}
+
+	if !reflect.DeepEqual(ports, []int{80, 81, 82}) {
+		t.Errorf("remote ports %v; expected main config's first, then included ones by file name", ports)
+	}
+}
+
+// different in the files, same once ${VAR}s are expanded
+func TestDuplicateRemotesAreCheckedAfterEnvExpansion(t *testing.T) {
+	t.Setenv("HOLEPUNCH_TEST_BIND_A", "127.0.0.1")
+	t.Setenv("HOLEPUNCH_TEST_BIND_B", "127.0.0.1")
+
+	configPath := writeIncludeTestFiles(t, map[string]string{
+		"holepunch.json":    includingConfig,
+		"forwards.d/a.json": `{"forwards": [{ "local": { "port": 8081 }, "remote": { "host": "${HOLEPUNCH_TEST_BIND_B}", "port": 80 } }]}`,
+	})
+
+	_, err := ReadConfigFile(configPath)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	if !strings.Contains(err.Error(), "Duplicate remote 127.0.0.1:80") || !strings.Contains(err.Error(), "a.json") {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+}
+
+func TestConfigFilePatterns(t *testing.T) {
+	configPath := writeIncludeTestFiles(t, map[string]string{
+		"holepunch.json": includingConfig,
+	})
+
+	patterns, err := ConfigFilePatterns(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{configPath, filepath.Join(filepath.Dir(configPath), "forwards.d/*.json")}
+
+	if !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("%v; expected %v", patterns, expected)
+	}
+}
+
+// writes files (paths relative to one temp directory). returns holepunch.json's path
+func writeIncludeTestFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return filepath.Join(dir, "holepunch.json")
+}
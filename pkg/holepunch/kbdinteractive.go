@@ -0,0 +1,116 @@
+package holepunch
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"strings"
+	"sync"
+)
+
+func usesKeyboardInteractive(server SshServer) bool {
+	return server.KeyboardInteractive || len(server.KeyboardInteractiveResponses) > 0
+}
+
+// answers from KeyboardInteractiveResponses if there's one for the prompt, otherwise asks on
+// the terminal. without a terminal (like when running as a service) an unknown prompt fails
+// the authentication
+func keyboardInteractiveChallenge(server SshServer) ssh.KeyboardInteractiveChallenge {
+	return func(name string, instruction string, questions []string, echos []bool) ([]string, error) {
+		sshTrace(fmt.Sprintf("keyboard-interactive: server asks %q", questions))
+
+		answers := []string{}
+
+		for i, question := range questions {
+			if response, found := server.KeyboardInteractiveResponses[strings.TrimSpace(question)]; found {
+				answer, err := keyboardInteractiveResponse(response)
+				if err != nil {
+					return nil, fmt.Errorf("keyboard-interactive prompt %q: %s", strings.TrimSpace(question), err.Error())
+				}
+
+				answers = append(answers, answer)
+				continue
+			}
+
+			if !stdinIsTerminal() {
+				return nil, fmt.Errorf(
+					"keyboard-interactive prompt %q: no response in keyboard_interactive_responses (and stdin is not a terminal to ask from)",
+					strings.TrimSpace(question))
+			}
+
+			answer, err := askOnTerminal(server.Address, name, instruction, question, echos[i])
+			if err != nil {
+				return nil, fmt.Errorf("keyboard-interactive prompt %q: %s", strings.TrimSpace(question), err.Error())
+			}
+
+			answers = append(answers, answer)
+		}
+
+		return answers, nil
+	}
+}
+
+// literal, or "<scheme>:<ref>" like "env:SSH_PASSWORD" (same sources as for private keys)
+func keyboardInteractiveResponse(response string) (string, error) {
+	scheme, ref := privateKeySourceScheme(response)
+	if scheme == "" {
+		return response, nil
+	}
+
+	value, err := privateKeySources[scheme](ref)
+	if err != nil {
+		return "", err
+	}
+
+	return string(value), nil
+}
+
+// many tunnels can be connecting at once (connect-all), but only one can use the terminal
+var terminalMu sync.Mutex
+
+func askOnTerminal(address string, name string, instruction string, question string, echo bool) (string, error) {
+	terminalMu.Lock()
+	defer terminalMu.Unlock()
+
+	fmt.Fprintf(os.Stderr, "%s (keyboard-interactive)\n", address)
+
+	for _, header := range []string{name, instruction} {
+		if header != "" {
+			fmt.Fprintln(os.Stderr, header)
+		}
+	}
+
+	fmt.Fprint(os.Stderr, question)
+
+	if echo {
+		return readLineFromStdin()
+	}
+
+	return readLineFromStdinWithoutEcho()
+}
+
+// byte at a time, so that nothing is buffered away from the next read
+func readLineFromStdin() (string, error) {
+	line := []byte{}
+	buf := make([]byte, 1)
+
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n == 1 {
+			if buf[0] == '\n' {
+				return strings.TrimSuffix(string(line), "\r"), nil
+			}
+
+			line = append(line, buf[0])
+		}
+
+		if err != nil {
+			if len(line) > 0 {
+				return string(line), nil
+			}
+
+			return "", errors.New("stdin closed")
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package holepunch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"time"
+)
+
+// like OpenSSH's ServerAliveInterval & ServerAliveCountMax. a silently dropped network can
+// otherwise go unnoticed for a long time. reports on ch failed after countMax consecutive
+// failures, and stops when ctx is cancelled.
+func sshKeepalive(
+	ctx context.Context,
+	sshClient *ssh.Client,
+	interval time.Duration,
+	countMax int,
+	failed chan<- error,
+) {
+	log := newLogger("sshKeepalive")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	consecutiveFailures := 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// server replying with failure (= doesn't know this request) still proves it's alive
+		err := sendKeepalive(sshClient, interval)
+		if err == nil {
+			consecutiveFailures = 0
+			continue
+		}
+
+		consecutiveFailures++
+
+		log.Error(fmt.Sprintf("failure %d/%d: %s", consecutiveFailures, countMax, err.Error()))
+
+		if consecutiveFailures >= countMax {
+			failed <- fmt.Errorf("keepalive: server unresponsive: %s", err.Error())
+			return
+		}
+	}
+}
+
+// SendRequest() waits for reply indefinitely, which is exactly what happens when the
+// network is dead, so we must bound it ourselves
+func sendKeepalive(sshClient *ssh.Client, timeout time.Duration) error {
+	result := make(chan error, 1)
+
+	go func() {
+		sshTrace("global request: keepalive@openssh.com")
+
+		accepted, _, err := sshClient.SendRequest("keepalive@openssh.com", true, nil)
+		if err == nil {
+			sshTrace(fmt.Sprintf("global request: keepalive@openssh.com: reply (success=%v)", accepted))
+		}
+
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return errors.New("timed out waiting for reply")
+	}
+}
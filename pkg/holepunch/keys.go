@@ -0,0 +1,220 @@
+package holepunch
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"strings"
+)
+
+// one key pair per distinct key file. servers with inline key (or key from stdin or ENV)
+// are left alone
+func GenerateKeypairs(conf *Configuration, force bool) error {
+	log := newLogger("generateKeypair")
+
+	generated := map[string]bool{}
+
+	for _, server := range conf.SshServers {
+		if server.PrivateKey != "" || server.PrivateKeyFilePath == "" || generated[server.PrivateKeyFilePath] {
+			continue
+		}
+
+		if !isPrivateKeyFilePath(server.PrivateKeyFilePath) {
+			continue
+		}
+		generated[server.PrivateKeyFilePath] = true
+
+		if err := generateKeypair(server.PrivateKeyFilePath, force); err != nil {
+			return err
+		}
+
+		log.Info(fmt.Sprintf("wrote private key to %s", server.PrivateKeyFilePath))
+	}
+
+	if len(generated) == 0 {
+		return errors.New("No private_key_file_path configured")
+	}
+
+	return nil
+}
+
+func generateKeypair(privateKeyFilePath string, force bool) error {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	privateKeyPem, err := marshalEd25519PrivateKey(privateKey, "holepunch")
+	if err != nil {
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	keyFile, err := os.OpenFile(privateKeyFilePath, flags, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%s already exists; use --force to overwrite it", privateKeyFilePath)
+		}
+
+		return err
+	}
+
+	// the mode above only applies to new files, so an overwritten key file would keep its old
+	// (maybe world-readable) permissions
+	if err := keyFile.Chmod(0600); err != nil {
+		keyFile.Close()
+		return err
+	}
+
+	if _, err := keyFile.Write(privateKeyPem); err != nil {
+		keyFile.Close()
+		return err
+	}
+
+	return keyFile.Close()
+}
+
+// for generate_key_if_missing. the first connect will fail authentication until the public
+// key is added to the server, but after that there's nothing else to set up
+func generateKeyIfMissing(server SshServer) error {
+	privateKeyFilePath := keyFileToGenerate(server)
+	if privateKeyFilePath == "" {
+		return nil
+	}
+
+	log := newLogger("generateKeyIfMissing")
+
+	if err := generateKeypair(privateKeyFilePath, false); err != nil {
+		return fmt.Errorf("generate_key_if_missing: %s", err.Error())
+	}
+
+	key, err := loadPrivateKeySigner(privateKeyFilePath)
+	if err != nil {
+		return err
+	}
+
+	log.Info(fmt.Sprintf("%s did not exist; generated new ed25519 key", privateKeyFilePath))
+	log.Info(fmt.Sprintf(
+		"add this line to authorized_keys of user %s on %s (until then, authentication fails):",
+		server.Username,
+		server.Address))
+	log.Info(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key.PublicKey()))))
+
+	return nil
+}
+
+// "" if there's nothing to generate
+func keyFileToGenerate(server SshServer) string {
+	if !server.GenerateKeyIfMissing || server.PrivateKey != "" || server.PrivateKeyFilePath == "" || !isPrivateKeyFilePath(server.PrivateKeyFilePath) {
+		return ""
+	}
+
+	if _, err := os.Stat(server.PrivateKeyFilePath); !os.IsNotExist(err) {
+		return ""
+	}
+
+	return server.PrivateKeyFilePath
+}
+
+// the SSH library can't (yet) marshal private keys. ed25519 keys are only supported in
+// OpenSSH's own format (unencrypted):
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.key
+func marshalEd25519PrivateKey(privateKey ed25519.PrivateKey, comment string) ([]byte, error) {
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+
+	checkBytes := make([]byte, 4)
+	if _, err := rand.Read(checkBytes); err != nil {
+		return nil, err
+	}
+	check := binary.BigEndian.Uint32(checkBytes)
+
+	privKeyBlock := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+	}{
+		Check1:  check,
+		Check2:  check,
+		Keytype: ssh.KeyAlgoED25519,
+		Pub:     publicKey,
+		Priv:    privateKey,
+		Comment: comment,
+	})
+
+	// padded to cipher block size ("none" = 8) with bytes 1, 2, 3, ...
+	for i := byte(1); len(privKeyBlock)%8 != 0; i++ {
+		privKeyBlock = append(privKeyBlock, i)
+	}
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := ssh.Marshal(struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{
+		CipherName:   "none",
+		KdfName:      "none",
+		KdfOpts:      "",
+		NumKeys:      1,
+		PubKey:       sshPublicKey.Marshal(),
+		PrivKeyBlock: privKeyBlock,
+	})
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: append([]byte("openssh-key-v1\x00"), envelope...),
+	}), nil
+}
+
+// public keys in authorized_keys format. same key used for many servers is listed only once
+func AuthorizedKeys(conf *Configuration) ([]string, error) {
+	authorizedKeys := []string{}
+	listed := map[string]bool{}
+
+	for _, server := range conf.SshServers {
+		if !hasPrivateKeys(server) {
+			continue // agent-only
+		}
+
+		keys, err := privateKeySigners(server)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			// authorized_keys needs the plain key, which is also offered
+			if _, isCert := key.PublicKey().(*ssh.Certificate); isCert {
+				continue
+			}
+
+			authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key.PublicKey())))
+			if listed[authorizedKey] {
+				continue
+			}
+			listed[authorizedKey] = true
+
+			authorizedKeys = append(authorizedKeys, authorizedKey)
+		}
+	}
+
+	return authorizedKeys, nil
+}
@@ -0,0 +1,56 @@
+package holepunch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestGenerateKeypairRefusesToOverwrite(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+
+	if err := ioutil.WriteFile(keyFile, []byte("old key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := generateKeypair(keyFile, false)
+	if err == nil || !strings.Contains(err.Error(), "use --force") {
+		t.Fatalf("expected already exists error; got %v", err)
+	}
+
+	if content, _ := ioutil.ReadFile(keyFile); string(content) != "old key" {
+		t.Errorf("key file was overwritten: %s", content)
+	}
+}
+
+func TestGenerateKeypairForceResetsPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix permissions on windows")
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+
+	if err := ioutil.WriteFile(keyFile, []byte("old key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := generateKeypair(keyFile, true); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("key file mode = %o; expected 600", mode)
+	}
+
+	if _, err := loadPrivateKeySigner(keyFile); err != nil {
+		t.Errorf("overwritten key doesn't load: %s", err.Error())
+	}
+}
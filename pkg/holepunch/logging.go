@@ -0,0 +1,84 @@
+package holepunch
+
+// gokit's logger has no notion of levels, so this is a drop-in with the same output format
+// that drops messages below the configured level
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+type logLevel int
+
+const (
+	logLevelDebug logLevel = iota
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+var logLevelNames = map[string]logLevel{
+	"debug": logLevelDebug,
+	"info":  logLevelInfo,
+	"warn":  logLevelWarn,
+	"error": logLevelError,
+}
+
+// shared by all loggers. set once at startup from --log-level
+var currentLogLevel = logLevelInfo
+
+// "debug", "info" (default), "warn" or "error". applies to all loggers
+func SetLogLevel(name string) error {
+	level, found := logLevelNames[strings.ToLower(name)]
+	if !found {
+		return fmt.Errorf("unknown log level: %s (valid: debug, info, warn, error)", name)
+	}
+
+	currentLogLevel = level
+
+	return nil
+}
+
+type Logger struct {
+	middle string
+}
+
+func newLogger(componentName string) *Logger {
+	return &Logger{
+		middle: "] " + componentName + ": ",
+	}
+}
+
+// for embedders (like our CLI) whose messages should look like ours
+func NewLogger(componentName string) *Logger {
+	return newLogger(componentName)
+}
+
+// [DEBUG] componentName: your message
+func (l *Logger) Debug(msg string) {
+	l.print(logLevelDebug, "DEBUG", msg)
+}
+
+// [INFO] componentName: your message
+func (l *Logger) Info(msg string) {
+	l.print(logLevelInfo, "INFO", msg)
+}
+
+// [WARN] componentName: your message
+func (l *Logger) Warn(msg string) {
+	l.print(logLevelWarn, "WARN", msg)
+}
+
+// [ERROR] componentName: your message
+func (l *Logger) Error(msg string) {
+	l.print(logLevelError, "ERROR", msg)
+}
+
+func (l *Logger) print(level logLevel, levelName string, msg string) {
+	if level < currentLogLevel {
+		return
+	}
+
+	log.Println("[" + levelName + l.middle + msg)
+}
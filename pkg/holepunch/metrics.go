@@ -0,0 +1,170 @@
+package holepunch
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// series are labeled by the forward's listen address (remote address for reverse forwards)
+type metricsCollection struct {
+	connectionsAccepted  *prometheus.CounterVec
+	connectionsActive    *prometheus.GaugeVec
+	connectionsOverLimit *prometheus.CounterVec
+	// rejected because of max_total_connections
+	connectionsOverTotalLimit *prometheus.CounterVec
+	// closed by us because of max_connection_duration
+	connectionsMaxDuration *prometheus.CounterVec
+	listeningPort          *prometheus.GaugeVec
+	circuitOpen            *prometheus.GaugeVec   // circuit_breaker_threshold
+	bytesIn                *prometheus.CounterVec // client -> service
+	bytesOut               *prometheus.CounterVec // service -> client
+	reconnects             prometheus.Counter
+	sshChannelWaits        prometheus.Counter // max_channels
+	sshConnectionUp        prometheus.Gauge   // count, since connect-all can have many
+}
+
+var metrics = newMetricsCollection()
+
+func newMetricsCollection() *metricsCollection {
+	collection := &metricsCollection{
+		connectionsAccepted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "holepunch_connections_accepted_total",
+			Help: "Connections accepted",
+		}, []string{"forward"}),
+		connectionsActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "holepunch_connections_active",
+			Help: "Connections currently being piped",
+		}, []string{"forward"}),
+		connectionsOverLimit: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "holepunch_connections_over_limit_total",
+			Help: "Connections that hit max_concurrent_connections (rejected or queued)",
+		}, []string{"forward"}),
+		connectionsOverTotalLimit: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "holepunch_connections_over_total_limit_total",
+			Help: "Connections rejected because of max_total_connections",
+		}, []string{"forward"}),
+		connectionsMaxDuration: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "holepunch_connections_max_duration_total",
+			Help: "Connections closed because they reached max_connection_duration",
+		}, []string{"forward"}),
+		listeningPort: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "holepunch_forward_listening_port",
+			Help: "Port actually listened on (can be server-assigned), 0 if not listening",
+		}, []string{"forward"}),
+		circuitOpen: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "holepunch_forward_circuit_open",
+			Help: "1 if circuit breaker is open (connections rejected without dialing local service)",
+		}, []string{"forward"}),
+		bytesIn: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "holepunch_bytes_in_total",
+			Help: "Bytes received from clients",
+		}, []string{"forward"}),
+		bytesOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "holepunch_bytes_out_total",
+			Help: "Bytes sent to clients",
+		}, []string{"forward"}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "holepunch_reconnects_total",
+			Help: "Reconnections to the SSH server",
+		}),
+		sshChannelWaits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "holepunch_ssh_channel_waits_total",
+			Help: "Connections that had to wait because of max_channels",
+		}),
+		sshConnectionUp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "holepunch_ssh_connection_up",
+			Help: "SSH server connections currently up",
+		}),
+	}
+
+	prometheus.MustRegister(
+		collection.connectionsAccepted,
+		collection.connectionsActive,
+		collection.connectionsOverLimit,
+		collection.connectionsOverTotalLimit,
+		collection.connectionsMaxDuration,
+		collection.listeningPort,
+		collection.circuitOpen,
+		collection.bytesIn,
+		collection.bytesOut,
+		collection.reconnects,
+		collection.sshChannelWaits,
+		collection.sshConnectionUp)
+
+	return collection
+}
+
+func serveMetrics(addr string) {
+	log := newLogger("serveMetrics")
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Info(fmt.Sprintf("listening on %s", addr))
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// listenAddr is nil when not listening. Unix sockets don't have a port
+func setListeningPortMetric(forward Forward, listenAddr net.Addr) {
+	port := 0
+	if tcpAddr, isTcp := listenAddr.(*net.TCPAddr); isTcp {
+		port = tcpAddr.Port
+	}
+
+	metrics.listeningPort.WithLabelValues(forward.listenEndpoint().String()).Set(float64(port))
+}
+
+// counts bytes flowing through the conn
+type countingConn struct {
+	net.Conn
+	onRead  func(n int)
+	onWrite func(n int)
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.onRead(n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.onWrite(n)
+	return n, err
+}
+
+// totals of a single connection
+type connectionStats struct {
+	bytesFromClient int64
+	bytesToClient   int64
+}
+
+// wraps client conn. stats are updated from both pipe directions, so read them only after
+// piping has finished
+func instrumentClient(client net.Conn, forward Forward, stats *connectionStats, bytesTransferred *int64) net.Conn {
+	label := forward.listenEndpoint().String()
+
+	bytesIn := metrics.bytesIn.WithLabelValues(label)
+	bytesOut := metrics.bytesOut.WithLabelValues(label)
+
+	return &countingConn{
+		Conn: client,
+		onRead: func(n int) {
+			bytesIn.Add(float64(n))
+			stats.bytesFromClient += int64(n)
+			atomic.AddInt64(bytesTransferred, int64(n))
+		},
+		onWrite: func(n int) {
+			bytesOut.Add(float64(n))
+			stats.bytesToClient += int64(n)
+			atomic.AddInt64(bytesTransferred, int64(n))
+		},
+	}
+}
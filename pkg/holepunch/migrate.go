@@ -0,0 +1,172 @@
+package holepunch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+)
+
+// bumped when the config's shape changes so that older configs need migrating
+const currentConfigVersion = 2
+
+// configMigrations[i] migrates a config from version i+1 to i+2. each one returns
+// descriptions of what it changed (= deprecated things found), if anything
+var configMigrations = []func(doc map[string]interface{}) ([]string, error){
+	migrateSingleSshServer, // 1 -> 2
+}
+
+// version 1 had one "ssh_server" instead of the "ssh_servers" list
+func migrateSingleSshServer(doc map[string]interface{}) ([]string, error) {
+	server, found := doc["ssh_server"]
+	if !found {
+		return nil, nil
+	}
+
+	if _, hasServers := doc["ssh_servers"]; hasServers {
+		return nil, errors.New("Both ssh_server and ssh_servers given; move ssh_server into ssh_servers")
+	}
+
+	delete(doc, "ssh_server")
+	doc["ssh_servers"] = []interface{}{server}
+
+	return []string{"ssh_server is deprecated: it's now the first item of ssh_servers"}, nil
+}
+
+// returns the config migrated to currentConfigVersion, or nil if it's current already.
+// configs without config_version are taken to be version 1, but are left alone if nothing
+// in them needs migrating
+func migrateConfig(content []byte, yamlFormat bool) ([]byte, []string, error) {
+	doc := map[string]interface{}{}
+	if err := decodeConfigDocument(content, yamlFormat, &doc); err != nil {
+		return nil, nil, err
+	}
+
+	version := 1
+	if versionValue, found := doc["config_version"]; found {
+		var err error
+		version, err = configVersionFromDocument(versionValue)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if version == currentConfigVersion {
+		return nil, nil, nil
+	}
+
+	if version < 1 || version > currentConfigVersion {
+		return nil, nil, fmt.Errorf(
+			"Unsupported config_version %d (this version of holepunch supports up to %d)",
+			version,
+			currentConfigVersion)
+	}
+
+	changes := []string{}
+	for _, migration := range configMigrations[version-1:] {
+		migrationChanges, err := migration(doc)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		changes = append(changes, migrationChanges...)
+	}
+
+	if _, found := doc["config_version"]; !found && len(changes) == 0 {
+		return nil, nil, nil
+	}
+
+	doc["config_version"] = currentConfigVersion
+
+	migrated, err := encodeConfigDocument(doc, yamlFormat)
+	return migrated, changes, err
+}
+
+// rewrites the config file migrated to currentConfigVersion, keeping the previous one as
+// <path>.bak. returns the backup's path, or "" if the file was current already. the result is
+// generated from the parsed file, so comments (YAML) are lost and keys are sorted
+func MigrateConfigFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	yamlFormat := isYamlConfigFile(path)
+
+	migrated, _, err := migrateConfig(content, yamlFormat)
+	if err != nil || migrated == nil {
+		return "", err
+	}
+
+	// don't replace a file that works (with migration in memory) with one that doesn't
+	if err := decodeStrict(migrated, yamlFormat, &Configuration{}); err != nil {
+		return "", fmt.Errorf("migrated config would be invalid: %s", err.Error())
+	}
+
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	backupFile := path + ".bak"
+
+	if err := ioutil.WriteFile(backupFile, content, fileInfo.Mode().Perm()); err != nil {
+		return "", err
+	}
+
+	// atomic, so a crash can't leave a half-written config
+	tempFile := path + ".migrating"
+
+	if err := ioutil.WriteFile(tempFile, migrated, fileInfo.Mode().Perm()); err != nil {
+		return "", err
+	}
+
+	return backupFile, os.Rename(tempFile, path)
+}
+
+func configVersionFromDocument(value interface{}) (int, error) {
+	switch value := value.(type) {
+	case json.Number:
+		version, err := value.Int64()
+		if err != nil {
+			return 0, fmt.Errorf("Invalid config_version: %s", value)
+		}
+
+		return int(version), nil
+	case int:
+		return value, nil
+	default:
+		return 0, fmt.Errorf("Invalid config_version: %v", value)
+	}
+}
+
+// like decodeStrict(), but into a generic document that can hold older config shapes
+func decodeConfigDocument(content []byte, yamlFormat bool, doc *map[string]interface{}) error {
+	if yamlFormat {
+		return yaml.Unmarshal(content, doc)
+	}
+
+	jsonDecoder := json.NewDecoder(bytes.NewReader(content))
+	jsonDecoder.UseNumber() // so that numbers are written back as they were
+	return jsonDecoder.Decode(doc)
+}
+
+func encodeConfigDocument(doc map[string]interface{}, yamlFormat bool) ([]byte, error) {
+	if yamlFormat {
+		return yaml.Marshal(doc)
+	}
+
+	encoded := &bytes.Buffer{}
+
+	jsonEncoder := json.NewEncoder(encoded)
+	jsonEncoder.SetEscapeHTML(false)
+	jsonEncoder.SetIndent("", "\t")
+	if err := jsonEncoder.Encode(doc); err != nil {
+		return nil, err
+	}
+
+	return encoded.Bytes(), nil
+}
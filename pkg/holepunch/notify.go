@@ -0,0 +1,96 @@
+package holepunch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	eventConnected     = "connected"
+	eventDisconnected  = "disconnected"
+	eventConnectFailed = "connect_failed"
+)
+
+type notificationEvent struct {
+	Event     string    `json:"event"`
+	Timestamp time.Time `json:"timestamp"`
+	Server    string    `json:"server"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// nil notifier is usable, and does nothing
+type webhookNotifier struct {
+	url        string
+	httpClient *http.Client
+	inFlight   sync.WaitGroup
+}
+
+func newWebhookNotifier(conf Notifications) *webhookNotifier {
+	if conf.WebhookURL == "" {
+		return nil
+	}
+
+	return &webhookNotifier{
+		url:        conf.WebhookURL,
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// best-effort, and doesn't block. err can be nil
+func (w *webhookNotifier) notify(event string, server string, err error) {
+	if w == nil {
+		return
+	}
+
+	payload := notificationEvent{
+		Event:     event,
+		Timestamp: time.Now().UTC(),
+		Server:    server,
+	}
+
+	if err != nil {
+		payload.Error = err.Error()
+	}
+
+	w.inFlight.Add(1)
+
+	go func() {
+		defer w.inFlight.Done()
+
+		if err := w.post(payload); err != nil {
+			newLogger("webhookNotifier").Warn(fmt.Sprintf("%s event: %s", event, err.Error()))
+		}
+	}()
+}
+
+// so that events just before exiting are not lost. waits at most for the HTTP timeout
+func (w *webhookNotifier) waitForDeliveries() {
+	if w == nil {
+		return
+	}
+
+	w.inFlight.Wait()
+}
+
+func (w *webhookNotifier) post(payload notificationEvent) error {
+	asJson, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.httpClient.Post(w.url, "application/json", bytes.NewReader(asJson))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package holepunch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// same as io.Copy(). BenchmarkPipe: 16-64 KB are within noise of each other and 256 KB only
+// ~15 % faster on loopback, far above what an SSH channel carries, for 8x the memory
+const defaultPipeBufferSize = 32 * 1024
+
+// like bidipipe.Pipe(), but with configurable buffer size. returns after both directions
+// are done. the first error is returned. once a direction is done we close both ends, so the
+// errors the other direction then gets are expected and not returned
+func pipe(party1 io.ReadWriteCloser, party1Name string, party2 io.ReadWriteCloser, party2Name string, bufferSize int) error {
+	allIoFinished := &sync.WaitGroup{}
+	allIoFinished.Add(2)
+
+	firstErrorCh := make(chan error, 2)
+
+	closing := new(int32)
+
+	go pipeOneDir(party1, party1Name, party2, party2Name, bufferSize, closing, allIoFinished, firstErrorCh)
+	go pipeOneDir(party2, party2Name, party1, party1Name, bufferSize, closing, allIoFinished, firstErrorCh)
+
+	allIoFinished.Wait()
+
+	select {
+	case firstError := <-firstErrorCh:
+		return firstError
+	default:
+		return nil
+	}
+}
+
+func pipeOneDir(
+	dst io.ReadWriteCloser,
+	dstName string,
+	src io.ReadWriteCloser,
+	srcName string,
+	bufferSize int,
+	closing *int32, // set when either direction has started closing the ends
+	done *sync.WaitGroup,
+	firstErrorCh chan error,
+) {
+	defer done.Done()
+
+	// hide ReadFrom()/WriteTo(), which would make CopyBuffer() ignore our buffer
+	onlyWriter := struct{ io.Writer }{dst}
+	onlyReader := struct{ io.Reader }{src}
+
+	_, err := io.CopyBuffer(onlyWriter, onlyReader, make([]byte, bufferSize))
+
+	// swap, so that of the two directions only the first one to finish reports its error
+	if !atomic.CompareAndSwapInt32(closing, 0, 1) {
+		return
+	}
+
+	if err != nil {
+		firstErrorCh <- fmt.Errorf("pipe: %s -> %s error: %w", srcName, dstName, err)
+	}
+
+	// either direction can fail from either its read or write side, so close both ends
+	src.Close()
+	dst.Close()
+}
+
+// the usual ways for a connection to end when a party goes away abruptly (like a client
+// disconnecting mid-transfer or a local service restarting). not worth an error in the log
+func isBenignPipeError(err error) bool {
+	if errors.Is(err, io.EOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	// Windows' equivalents (WSAECONNRESET etc.) aren't matched by the syscall constants
+	message := err.Error()
+
+	return strings.Contains(message, "connection reset") ||
+		strings.Contains(message, "forcibly closed by the remote host") ||
+		strings.Contains(message, "broken pipe")
+}
@@ -0,0 +1,83 @@
+package holepunch
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// go test -bench Pipe ./pkg/holepunch/ for choosing defaultPipeBufferSize
+func BenchmarkPipe(b *testing.B) {
+	for _, bufferSize := range []int{16 * 1024, 32 * 1024, 64 * 1024, 256 * 1024} {
+		b.Run(fmt.Sprintf("%dKB", bufferSize/1024), func(b *testing.B) {
+			benchmarkPipe(b, bufferSize)
+		})
+	}
+}
+
+// client -> [pipe] -> service over loopback TCP, like a forward's two ends
+func benchmarkPipe(b *testing.B, bufferSize int) {
+	const transferSize = 16 * 1024 * 1024
+
+	payload := make([]byte, 256*1024)
+
+	b.SetBytes(transferSize)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		client, clientSide := tcpPairForBenchmark(b)
+		serviceSide, service := tcpPairForBenchmark(b)
+		b.StartTimer()
+
+		piped := make(chan error, 1)
+		go func() {
+			piped <- pipe(clientSide, "client", serviceSide, "service", bufferSize)
+		}()
+
+		go func() {
+			for written := 0; written < transferSize; written += len(payload) {
+				if _, err := client.Write(payload); err != nil {
+					return
+				}
+			}
+
+			client.(*net.TCPConn).CloseWrite()
+		}()
+
+		received, err := io.Copy(ioutil.Discard, service)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if received != transferSize {
+			b.Fatalf("received %d bytes; expected %d", received, transferSize)
+		}
+
+		service.Close()
+		client.Close()
+		<-piped
+	}
+}
+
+func tcpPairForBenchmark(b *testing.B) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	accepted, err := listener.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return dialed, accepted
+}
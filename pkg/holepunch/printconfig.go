@@ -0,0 +1,69 @@
+package holepunch
+
+import (
+	"net/url"
+)
+
+const redacted = "(redacted)"
+
+// paths to secrets are left alone, but secrets themselves are not shown
+func RedactSecrets(conf Configuration) Configuration {
+	conf.SshServers = redactServerSecrets(conf.SshServers)
+
+	return conf
+}
+
+func redactServerSecrets(originals []SshServer) []SshServer {
+	servers := []SshServer{}
+
+	for _, server := range originals {
+		if server.PrivateKey != "" {
+			server.PrivateKey = redacted
+		}
+
+		if server.JumpHost != nil {
+			server.JumpHost = &redactServerSecrets([]SshServer{*server.JumpHost})[0]
+		}
+
+		// usually auth tokens
+		if server.WebsocketHeaders != nil {
+			headers := map[string]string{}
+			for key := range server.WebsocketHeaders {
+				headers[key] = redacted
+			}
+			server.WebsocketHeaders = headers
+		}
+
+		// "env:..." references are not secrets themselves
+		if server.KeyboardInteractiveResponses != nil {
+			responses := map[string]string{}
+			for prompt, response := range server.KeyboardInteractiveResponses {
+				if scheme, _ := privateKeySourceScheme(response); scheme != "" {
+					responses[prompt] = response
+				} else {
+					responses[prompt] = redacted
+				}
+			}
+			server.KeyboardInteractiveResponses = responses
+		}
+
+		server.ProxyURL = redactUrlPassword(server.ProxyURL)
+
+		servers = append(servers, server)
+	}
+
+	return servers
+}
+
+func redactUrlPassword(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil || parsed.User == nil {
+		return rawUrl
+	}
+
+	if _, hasPassword := parsed.User.Password(); hasPassword {
+		parsed.User = url.UserPassword(parsed.User.Username(), "xxxxx")
+	}
+
+	return parsed.String()
+}
@@ -0,0 +1,240 @@
+package holepunch
+
+// dialing the SSH server through a proxy. supported schemes: http:// (HTTP CONNECT) and
+// socks5://
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const proxyHandshakeTimeout = 10 * time.Second
+
+func init() {
+	// x/net/proxy only knows socks5 out of the box
+	proxy.RegisterDialerType("http", newHttpConnectDialer)
+}
+
+// explicit config takes precedence over ENV. returns nil if no proxy should be used
+func proxyUrlFor(server SshServer, addr string) (*url.URL, error) {
+	if server.ProxyURL != "" {
+		return parseProxyUrl(server.ProxyURL)
+	}
+
+	proxyFromEnv := firstNonEmptyEnv("HTTPS_PROXY", "https_proxy")
+	if proxyFromEnv == "" {
+		proxyFromEnv = firstNonEmptyEnv("ALL_PROXY", "all_proxy")
+	}
+
+	// httpproxy handles NO_PROXY and never proxies localhost
+	proxyUrl, err := (&httpproxy.Config{
+		HTTPSProxy: proxyFromEnv,
+		NoProxy:    firstNonEmptyEnv("NO_PROXY", "no_proxy"),
+	}).ProxyFunc()(&url.URL{Scheme: "https", Host: addr})
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proxy URL in ENV: %s", err.Error())
+	}
+
+	if proxyUrl == nil {
+		return nil, nil
+	}
+
+	return parseProxyUrl(proxyUrl.String())
+}
+
+func parseProxyUrl(raw string) (*url.URL, error) {
+	proxyUrl, err := url.Parse(raw)
+	if err != nil {
+		// not including the error because it'd contain the URL, which can contain a password
+		return nil, fmt.Errorf("Cannot parse proxy URL")
+	}
+
+	switch proxyUrl.Scheme {
+	case "http", "socks5":
+		return proxyUrl, nil
+	default:
+		return nil, fmt.Errorf("Unsupported proxy scheme '%s'; supported: http, socks5", proxyUrl.Scheme)
+	}
+}
+
+// cancelling ctx aborts connecting to the proxy and negotiating with it
+func dialThroughProxy(ctx context.Context, proxyUrl *url.URL, forward *net.Dialer, addr string) (net.Conn, error) {
+	proxyDialer, err := proxy.FromURL(proxyUrl, forward)
+	if err != nil {
+		return nil, err
+	}
+
+	// both x/net's SOCKS5 dialer and ours are
+	contextDialer, ok := proxyDialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("%s proxy dialer doesn't support cancellation", proxyUrl.Scheme)
+	}
+
+	// SOCKS5 negotiation has no timeout of its own
+	ctx, cancel := context.WithTimeout(ctx, forward.Timeout+proxyHandshakeTimeout)
+	defer cancel()
+
+	conn, err := contextDialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("via proxy %s: %w", proxyUrl.Host, err)
+	}
+
+	return conn, nil
+}
+
+type httpConnectDialer struct {
+	proxyUrl *url.URL
+	forward  proxy.Dialer
+}
+
+func newHttpConnectDialer(proxyUrl *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	return &httpConnectDialer{proxyUrl, forward}, nil
+}
+
+func (h *httpConnectDialer) Dial(network string, addr string) (net.Conn, error) {
+	return h.DialContext(context.Background(), network, addr)
+}
+
+func (h *httpConnectDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	proxyAddr := h.proxyUrl.Host
+	if h.proxyUrl.Port() == "" {
+		proxyAddr = net.JoinHostPort(h.proxyUrl.Hostname(), "80")
+	}
+
+	var conn net.Conn
+	var err error
+	if contextDialer, ok := h.forward.(proxy.ContextDialer); ok {
+		conn, err = contextDialer.DialContext(ctx, "tcp", proxyAddr)
+	} else {
+		conn, err = h.forward.Dial("tcp", proxyAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tunneled, err := h.connect(ctx, conn, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tunneled, nil
+}
+
+// the CONNECT exchange, which ends at proxyHandshakeTimeout, ctx's deadline or ctx being
+// cancelled, whichever comes first
+func (h *httpConnectDialer) connect(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	deadline := time.Now().Add(proxyHandshakeTimeout)
+	if ctxDeadline, has := ctx.Deadline(); has && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	stopAborting := abortOnCancel(ctx, conn)
+
+	res, connReader, err := h.exchange(conn, addr)
+
+	if cancelErr := stopAborting(); cancelErr != nil {
+		return nil, cancelErr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy CONNECT to %s failed: %s", addr, res.Status)
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	// SSH server speaks first, so its banner can already be in our read buffer
+	if connReader.Buffered() > 0 {
+		return &bufferedConn{conn, connReader}, nil
+	}
+
+	return conn, nil
+}
+
+func (h *httpConnectDialer) exchange(conn net.Conn, addr string) (*http.Response, *bufio.Reader, error) {
+	connectReq := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+
+	if user := h.proxyUrl.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := connectReq.Write(conn); err != nil {
+		return nil, nil, err
+	}
+
+	connReader := bufio.NewReader(conn)
+
+	res, err := http.ReadResponse(connReader, connectReq)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return res, connReader, nil
+}
+
+// until the returned func is called, cancelling ctx fails conn's pending reads and writes.
+// the func returns ctx's error if that happened. after it returns, conn's deadline is ours again
+func abortOnCancel(ctx context.Context, conn net.Conn) func() error {
+	stop := make(chan struct{})
+	result := make(chan error, 1)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0)) // in the past
+			result <- ctx.Err()
+		case <-stop:
+			result <- nil
+		}
+	}()
+
+	return func() error {
+		close(stop)
+		return <-result
+	}
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+func firstNonEmptyEnv(keys ...string) string {
+	for _, key := range keys {
+		if value := os.Getenv(key); value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
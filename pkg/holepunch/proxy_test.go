@@ -0,0 +1,111 @@
+package holepunch
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHttpConnectProxy(t *testing.T) {
+	target := listenForTest(t)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = conn.Write([]byte("SSH-2.0-banner\r\n"))
+	}()
+
+	proxyListener := listenForTest(t)
+	go func() {
+		client, err := proxyListener.Accept()
+		if err != nil {
+			return
+		}
+		defer client.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(client))
+		if err != nil || req.Method != "CONNECT" {
+			return
+		}
+
+		upstream, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+
+		_, _ = client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		_, _ = io.Copy(client, upstream)
+	}()
+
+	conn, err := dialThroughProxy(
+		context.Background(),
+		&url.URL{Scheme: "http", Host: proxyListener.Addr().String()},
+		&net.Dialer{Timeout: 5 * time.Second},
+		target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if banner != "SSH-2.0-banner\r\n" {
+		t.Errorf("unexpected banner %q", banner)
+	}
+}
+
+// a proxy that accepts but never answers CONNECT must not hold up shutdown
+func TestHttpConnectProxyHangingIsCancellable(t *testing.T) {
+	proxyListener := listenForTest(t)
+	go func() {
+		for {
+			conn, err := proxyListener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	started := time.Now()
+
+	_, err := dialThroughProxy(
+		ctx,
+		&url.URL{Scheme: "http", Host: proxyListener.Addr().String()},
+		&net.Dialer{Timeout: 5 * time.Second},
+		"ssh.example.com:22")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("cancellation took %s", elapsed)
+	}
+}
+
+func listenForTest(t *testing.T) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	return listener
+}
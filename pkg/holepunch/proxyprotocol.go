@@ -0,0 +1,116 @@
+package holepunch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+const (
+	proxyProtocolV1 = "v1"
+	proxyProtocolV2 = "v2"
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// tells the local service who the client really is: source = client, destination = address
+// the client connected to (on the SSH server for reverse forwards)
+func writeProxyProtocolHeader(conn net.Conn, version string, source net.Addr, destination net.Addr) error {
+	var header []byte
+
+	switch version {
+	case proxyProtocolV1:
+		header = proxyProtocolV1Header(source, destination)
+	case proxyProtocolV2:
+		header = proxyProtocolV2Header(source, destination)
+	default:
+		return fmt.Errorf("unknown PROXY protocol version: %s", version)
+	}
+
+	_, err := conn.Write(header)
+	return err
+}
+
+func proxyProtocolV1Header(source net.Addr, destination net.Addr) []byte {
+	sourceTcp, destinationTcp, bothIpv4, ok := tcpAddrPair(source, destination)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP6"
+	if bothIpv4 {
+		family = "TCP4"
+	}
+
+	return []byte(fmt.Sprintf(
+		"PROXY %s %s %s %d %d\r\n",
+		family,
+		proxyProtocolV1Ip(sourceTcp.IP, bothIpv4),
+		proxyProtocolV1Ip(destinationTcp.IP, bothIpv4),
+		sourceTcp.Port,
+		destinationTcp.Port))
+}
+
+func proxyProtocolV2Header(source net.Addr, destination net.Addr) []byte {
+	header := &bytes.Buffer{}
+	header.Write(proxyProtocolV2Signature)
+
+	sourceTcp, destinationTcp, bothIpv4, ok := tcpAddrPair(source, destination)
+	if !ok {
+		// LOCAL command, unspecified family: receiver uses the connection's own addresses
+		header.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return header.Bytes()
+	}
+
+	var addresses []byte
+	var family byte
+
+	if bothIpv4 {
+		family = 0x11 // TCP over IPv4
+		addresses = append(addresses, sourceTcp.IP.To4()...)
+		addresses = append(addresses, destinationTcp.IP.To4()...)
+	} else {
+		family = 0x21 // TCP over IPv6
+		addresses = append(addresses, sourceTcp.IP.To16()...)
+		addresses = append(addresses, destinationTcp.IP.To16()...)
+	}
+
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], uint16(sourceTcp.Port))
+	binary.BigEndian.PutUint16(ports[2:4], uint16(destinationTcp.Port))
+	addresses = append(addresses, ports...)
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addresses)))
+
+	header.Write([]byte{0x21, family}) // version 2, PROXY command
+	header.Write(length)
+	header.Write(addresses)
+
+	return header.Bytes()
+}
+
+// PROXY protocol doesn't allow mixing families, so if only one is IPv4, both are presented
+// as IPv6 (IPv4-mapped)
+func tcpAddrPair(source net.Addr, destination net.Addr) (*net.TCPAddr, *net.TCPAddr, bool, bool) {
+	sourceTcp, sourceOk := source.(*net.TCPAddr)
+	destinationTcp, destinationOk := destination.(*net.TCPAddr)
+	if !sourceOk || !destinationOk || sourceTcp.IP == nil || destinationTcp.IP == nil {
+		return nil, nil, false, false
+	}
+
+	bothIpv4 := sourceTcp.IP.To4() != nil && destinationTcp.IP.To4() != nil
+
+	return sourceTcp, destinationTcp, bothIpv4, true
+}
+
+// Go would format IPv4-mapped IPv6 addresses as IPv4
+func proxyProtocolV1Ip(ip net.IP, ipv4 bool) string {
+	if !ipv4 && ip.To4() != nil {
+		return "::ffff:" + ip.To4().String()
+	}
+
+	return ip.String()
+}
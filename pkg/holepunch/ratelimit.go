@@ -0,0 +1,92 @@
+package holepunch
+
+import (
+	"context"
+	"golang.org/x/time/rate"
+	"net"
+)
+
+// limiter allows bursts of one second's worth of bytes. nil if unlimited
+func newBandwidthLimiter(bytesPerSecond int) *rate.Limiter {
+	if bytesPerSecond == 0 {
+		return nil
+	}
+
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), bytesPerSecond)
+}
+
+// limiters are shared by all connections of a forward
+type rateLimitedConn struct {
+	net.Conn
+	readLimiter  *rate.Limiter // nil = unlimited
+	writeLimiter *rate.Limiter // nil = unlimited
+}
+
+// wraps the side of the pipe that is the SSH connection: up = bytes we send to the SSH
+// server, down = bytes we receive from it
+func limitBandwidth(client net.Conn, remote net.Conn, forward Forward) (net.Conn, net.Conn) {
+	if forward.upLimiter == nil && forward.downLimiter == nil {
+		return client, remote
+	}
+
+	limit := func(sshSide net.Conn) net.Conn {
+		return &rateLimitedConn{
+			Conn:         sshSide,
+			readLimiter:  forward.downLimiter,
+			writeLimiter: forward.upLimiter,
+		}
+	}
+
+	if forward.Direction == forwardDirectionReverse {
+		return limit(client), remote
+	}
+
+	return client, limit(remote)
+}
+
+func (r *rateLimitedConn) Read(b []byte) (int, error) {
+	if r.readLimiter == nil {
+		return r.Conn.Read(b)
+	}
+
+	// can't wait for more than burst at once
+	if len(b) > r.readLimiter.Burst() {
+		b = b[:r.readLimiter.Burst()]
+	}
+
+	n, err := r.Conn.Read(b)
+	if n > 0 {
+		if errWait := r.readLimiter.WaitN(context.Background(), n); errWait != nil && err == nil {
+			err = errWait
+		}
+	}
+
+	return n, err
+}
+
+func (r *rateLimitedConn) Write(b []byte) (int, error) {
+	if r.writeLimiter == nil {
+		return r.Conn.Write(b)
+	}
+
+	written := 0
+
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > r.writeLimiter.Burst() {
+			chunk = chunk[:r.writeLimiter.Burst()]
+		}
+
+		if err := r.writeLimiter.WaitN(context.Background(), len(chunk)); err != nil {
+			return written, err
+		}
+
+		n, err := r.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
@@ -0,0 +1,243 @@
+package holepunch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"sync"
+)
+
+// forwards can change while connected, when config is reloaded (like on SIGHUP)
+type forwardSet struct {
+	mu       sync.Mutex
+	forwards []Forward
+	changed  chan struct{} // closed (and replaced) when forwards change
+}
+
+func newForwardSet(forwards []Forward) *forwardSet {
+	return &forwardSet{
+		forwards: forwards,
+		changed:  make(chan struct{}),
+	}
+}
+
+// current forwards and a chan that is closed when they change
+func (f *forwardSet) get() ([]Forward, <-chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.forwards, f.changed
+}
+
+func (f *forwardSet) set(forwards []Forward) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.forwards = forwards
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// only forwards are reloaded. other changes (like SSH server address or auth) would require
+// reconnecting, so for them we just tell that a restart is needed
+func reloadConfig(tun *tunnel) error {
+	log := newLogger("reloadConfig")
+
+	if tun.configFile == "" {
+		return errors.New("reload: config was not read from a file")
+	}
+
+	tun.reloadMu.Lock()
+	defer tun.reloadMu.Unlock()
+
+	conf, err := ReadConfigFile(tun.configFile)
+	if err != nil {
+		return fmt.Errorf("reload failed; keeping previous config: %s", err.Error())
+	}
+
+	if !sameSettingsExceptForwards(tun.conf, conf) {
+		log.Warn(fmt.Sprintf(
+			"%s: settings other than forwards changed (like ssh_servers); those need a restart to apply",
+			tun.configFile))
+	}
+
+	// connections of forwards that keep running hold slots of the previous semaphore
+	for i := range conf.Forwards {
+		conf.Forwards[i].totalSlots = tun.conf.totalConnectionSlots
+	}
+
+	enabled := EnabledForwards(conf.Forwards)
+
+	if len(enabled) == 0 && !conf.AllowNoForwards {
+		return fmt.Errorf("reload failed; keeping previous config: %s", errNoForwards.Error())
+	}
+
+	log.Info(fmt.Sprintf(
+		"reloaded %s with %d forward(s) (%d disabled)",
+		tun.configFile,
+		len(enabled),
+		len(conf.Forwards)-len(enabled)))
+
+	forwards := expandPortRanges(enabled)
+
+	tun.state.setForwards(forwards)
+	tun.forwards.set(forwards)
+
+	return nil
+}
+
+func sameSettingsExceptForwards(a *Configuration, b *Configuration) bool {
+	withoutForwards := func(conf *Configuration) string {
+		confCopy := *conf
+		confCopy.Forwards = nil
+		confCopy.ForwardsInclude = nil // included forwards are reloaded like the rest
+		return jsonKey(confCopy)
+	}
+
+	return withoutForwards(a) == withoutForwards(b)
+}
+
+type runningForward struct {
+	forward Forward
+	stop    context.CancelFunc
+	stopped chan struct{}
+}
+
+// forwards being served over one SSH connection
+type runningForwards struct {
+	ctx               context.Context
+	connectionsCtx    context.Context
+	sshClient         *ssh.Client
+	transport         *transportWatcher
+	activeConnections *sync.WaitGroup
+	state             *tunnelState
+	accessLog         *accessLog
+	connectionHandler ConnectionHandler
+	channelSlots      sshChannelSlots
+	byKey             map[string]*runningForward
+}
+
+func newRunningForwards(
+	ctx context.Context,
+	connectionsCtx context.Context,
+	sshClient *ssh.Client,
+	transport *transportWatcher,
+	activeConnections *sync.WaitGroup,
+	state *tunnelState,
+	accessLog *accessLog,
+	connectionHandler ConnectionHandler,
+	channelSlots sshChannelSlots,
+) *runningForwards {
+	return &runningForwards{
+		ctx:               ctx,
+		connectionsCtx:    connectionsCtx,
+		sshClient:         sshClient,
+		transport:         transport,
+		activeConnections: activeConnections,
+		state:             state,
+		accessLog:         accessLog,
+		connectionHandler: connectionHandler,
+		channelSlots:      channelSlots,
+		byKey:             map[string]*runningForward{},
+	}
+}
+
+// stops forwards that are no longer wanted and starts new ones. unchanged forwards are left
+// alone. if failOnListenError is false, Listen() errors are only logged
+func (r *runningForwards) reconcile(wanted []Forward, failOnListenError bool) error {
+	log := newLogger("reconcileForwards")
+
+	wantedKeys := map[string]bool{}
+	for _, forward := range wanted {
+		wantedKeys[jsonKey(forward)] = true
+	}
+
+	// stopped first, since a changed forward probably listens on the same address
+	for key, running := range r.byKey {
+		if wantedKeys[key] {
+			continue
+		}
+
+		running.stop()
+		<-running.stopped
+		delete(r.byKey, key)
+
+		log.Info(fmt.Sprintf("stopped forward %s", running.forward.listenEndpoint().String()))
+	}
+
+	for _, forward := range wanted {
+		key := jsonKey(forward)
+
+		if _, alreadyRunning := r.byKey[key]; alreadyRunning {
+			continue
+		}
+
+		listener, err := listenForForward(forward, r.sshClient)
+		if err != nil {
+			r.state.listenerFailed(forward, err)
+
+			if !forward.RetryListen {
+				if failOnListenError {
+					return err
+				}
+
+				log.Error(fmt.Sprintf("%s: %s", forward.listenEndpoint().String(), err.Error()))
+				continue
+			}
+
+			// serveForward() retries with nil listener
+			log.Error(fmt.Sprintf("%s: %s; retrying", forward.listenEndpoint().String(), err.Error()))
+			listener = nil
+		}
+
+		forwardCtx, stop := context.WithCancel(r.ctx)
+
+		running := &runningForward{
+			forward: forward,
+			stop:    stop,
+			stopped: make(chan struct{}),
+		}
+
+		r.byKey[key] = running
+
+		go func(forward Forward) {
+			defer close(running.stopped)
+
+			serveForward(
+				forwardCtx,
+				r.connectionsCtx,
+				forward,
+				listener,
+				r.sshClient,
+				r.transport,
+				r.activeConnections,
+				r.state,
+				r.accessLog,
+				r.connectionHandler,
+				r.channelSlots)
+		}(forward)
+	}
+
+	return nil
+}
+
+// for teardown. waits for the forwards' accept loops to return
+func (r *runningForwards) stopAll() {
+	for key, running := range r.byKey {
+		running.stop()
+		<-running.stopped
+		delete(r.byKey, key)
+	}
+}
+
+// only exported fields are included, so it's usable for comparing config items
+func jsonKey(item interface{}) string {
+	asJson, err := json.Marshal(item)
+	if err != nil {
+		panic(err)
+	}
+
+	return string(asJson)
+}
@@ -0,0 +1,162 @@
+package holepunch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// rotates the first server's private_key_file_path in steps that never leave us without a
+// working key: new key is generated to <key>.new and only replaces the key file after it's
+// been confirmed to authenticate to all servers using that key file. previous key is kept
+// as <key>.bak until ConfirmKeyRotation(). can be run again until the new key works
+func RotateKey(conf *Configuration, output io.Writer) error {
+	keyFile, servers, err := keyFileToRotate(conf)
+	if err != nil {
+		return err
+	}
+
+	newKeyFile := keyFile + ".new"
+	backupFile := keyFile + ".bak"
+
+	if _, err := os.Stat(backupFile); err == nil {
+		return fmt.Errorf("%s exists: previous rotation is not confirmed yet (see rotate-key --confirm)", backupFile)
+	}
+
+	if _, err := os.Stat(newKeyFile); os.IsNotExist(err) {
+		if err := generateKeypair(newKeyFile, false); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(output, "generated new key to %s\n", newKeyFile)
+	} else {
+		fmt.Fprintf(output, "using new key generated earlier in %s\n", newKeyFile)
+	}
+
+	newKey, err := loadPrivateKeySigner(newKeyFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "add this line to authorized_keys (keep the old key there for now):\n")
+	fmt.Fprintf(output, "%s\n", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(newKey.PublicKey()))))
+
+	if failed := testKeyAuthentication(servers, newKeyFile, output); failed > 0 {
+		return fmt.Errorf("New key doesn't authenticate to %d server(s) yet. add it to authorized_keys and run rotate-key again", failed)
+	}
+
+	previousKey, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(backupFile, previousKey, 0600); err != nil {
+		return err
+	}
+
+	// atomic, so a crash can't leave us without a key file
+	if err := os.Rename(newKeyFile, keyFile); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "replaced %s with the new key (restart holepunch to start using it). old key is in %s\n", keyFile, backupFile)
+	fmt.Fprintf(output, "remove the old key from authorized_keys, then run rotate-key --confirm\n")
+
+	return nil
+}
+
+// checks that the (rotated) key file authenticates alone and deletes the backup of the previous key
+func ConfirmKeyRotation(conf *Configuration, output io.Writer) error {
+	keyFile, servers, err := keyFileToRotate(conf)
+	if err != nil {
+		return err
+	}
+
+	backupFile := keyFile + ".bak"
+
+	if _, err := os.Stat(backupFile); err != nil {
+		return fmt.Errorf("No rotation to confirm: %s", err.Error())
+	}
+
+	if failed := testKeyAuthentication(servers, keyFile, output); failed > 0 {
+		return fmt.Errorf("%s doesn't authenticate to %d server(s); old key kept in %s", keyFile, failed, backupFile)
+	}
+
+	if err := os.Remove(backupFile); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "deleted %s\n", backupFile)
+
+	return nil
+}
+
+// the first server's key file, and servers that use it
+func keyFileToRotate(conf *Configuration) (string, []SshServer, error) {
+	primary := conf.SshServers[0]
+
+	if primary.PrivateKey != "" || primary.PrivateKeyFilePath == "" || !isPrivateKeyFilePath(primary.PrivateKeyFilePath) {
+		return "", nil, errors.New("Key rotation needs private_key_file_path that is a file (not an inline key, stdin or ENV)")
+	}
+
+	keyFile := primary.PrivateKeyFilePath
+
+	servers := []SshServer{}
+	for _, server := range conf.SshServers {
+		if server.PrivateKey != "" || server.PrivateKeyFilePath != keyFile {
+			continue
+		}
+
+		if server.CertificateFilePath != "" {
+			return "", nil, fmt.Errorf("%s: certificate_file_path is for the old key; rotate-key can't re-issue certificates", server.Address)
+		}
+
+		servers = append(servers, server)
+	}
+
+	return keyFile, servers, nil
+}
+
+// returns how many servers failed. only keyFile is offered, so that other keys can't
+// make authentication succeed
+func testKeyAuthentication(servers []SshServer, keyFile string, output io.Writer) int {
+	failed := 0
+
+	for _, server := range servers {
+		server.PrivateKeyFilePath = keyFile
+		server.PrivateKeyFilePaths = nil
+		server.UseAgent = false
+		server.KeyboardInteractive = false
+		server.KeyboardInteractiveResponses = nil
+		server.GenerateKeyIfMissing = false
+
+		if err := testAuthentication(server); err != nil {
+			failed++
+			fmt.Fprintf(output, "FAIL %s: %s\n", server.Address, err.Error())
+			continue
+		}
+
+		fmt.Fprintf(output, "OK   %s: %s authenticates\n", server.Address, keyFile)
+	}
+
+	return failed
+}
+
+func testAuthentication(server SshServer) error {
+	resolved, err := resolveSshServer(server)
+	if err != nil {
+		return err
+	}
+
+	sshClient, _, err := connectSsh(context.Background(), resolved)
+	if err != nil {
+		return err
+	}
+
+	return sshClient.Close()
+}
@@ -0,0 +1,234 @@
+package holepunch
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	selfTestPings       = 10
+	selfTestPingSize    = 64
+	selfTestPayloadSize = 4 * 1024 * 1024
+	selfTestTimeout     = 30 * time.Second
+)
+
+// for each server, loops a reverse forward back to ourselves: a port is bound on the server's
+// loopback and forwarded to an echo server of ours, and we connect to it through the SSH server
+// (like a local forward would). so data travels client -> server -> reverse tunnel -> echo
+// and back. echoed data is verified, and latency and throughput are measured. details are
+// written to output
+func SelfTest(conf *Configuration, output io.Writer) error {
+	failedServers := 0
+
+	for _, server := range conf.SshServers {
+		if err := selfTestServer(server, output); err != nil {
+			failedServers++
+			fmt.Fprintf(output, "FAIL %s: %s\n", server.Address, err.Error())
+		}
+	}
+
+	if failedServers > 0 {
+		return fmt.Errorf("%d/%d server(s) failed", failedServers, len(conf.SshServers))
+	}
+
+	return nil
+}
+
+func selfTestServer(server SshServer, output io.Writer) error {
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("echo server: %s", err.Error())
+	}
+	defer echoListener.Close()
+
+	go serveEcho(echoListener)
+
+	resolved, err := resolveSshServer(server)
+	if err != nil {
+		return err
+	}
+
+	connectStarted := time.Now()
+
+	sshClient, _, err := connectSsh(context.Background(), resolved)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+
+	fmt.Fprintf(output, "OK   connected to %s in %s\n", server.Address, time.Since(connectStarted).Round(time.Millisecond))
+
+	// port is chosen by the server, so this doesn't conflict with anything
+	remoteListener, err := sshClient.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("reverse forward: %s", err.Error())
+	}
+	defer remoteListener.Close()
+
+	fmt.Fprintf(output, "OK   reverse forward listening on %s (on the server)\n", remoteListener.Addr().String())
+
+	go forwardToEcho(remoteListener, echoListener.Addr().String())
+
+	conn, err := sshClient.Dial("tcp", remoteListener.Addr().String())
+	if err != nil {
+		return fmt.Errorf("connecting back through the server (does it allow local forwards?): %s", err.Error())
+	}
+	defer conn.Close()
+
+	// SSH channels don't support deadlines. closing the connection fails whatever waits on it
+	timedOut := new(int32)
+	timeout := time.AfterFunc(selfTestTimeout, func() {
+		atomic.StoreInt32(timedOut, 1)
+		conn.Close()
+	})
+	defer timeout.Stop()
+
+	withTimeout := func(err error) error {
+		if atomic.LoadInt32(timedOut) == 1 {
+			return fmt.Errorf("no echo within %s (client -> server -> reverse tunnel -> echo path is stuck)", selfTestTimeout)
+		}
+
+		return err
+	}
+
+	if err := selfTestLatency(conn, output); err != nil {
+		return withTimeout(err)
+	}
+
+	if err := selfTestThroughput(conn, output); err != nil {
+		return withTimeout(err)
+	}
+
+	fmt.Fprintf(output, "OK   full path works: client -> %s -> reverse tunnel -> local echo\n", server.Address)
+
+	return nil
+}
+
+func selfTestLatency(conn net.Conn, output io.Writer) error {
+	ping := make([]byte, selfTestPingSize)
+	pong := make([]byte, selfTestPingSize)
+
+	var min, max, total time.Duration
+
+	for i := 0; i < selfTestPings; i++ {
+		if _, err := rand.Read(ping); err != nil {
+			return err
+		}
+
+		sent := time.Now()
+
+		if _, err := conn.Write(ping); err != nil {
+			return fmt.Errorf("ping: %s", err.Error())
+		}
+
+		if _, err := io.ReadFull(conn, pong); err != nil {
+			return fmt.Errorf("ping: %s", err.Error())
+		}
+
+		roundTrip := time.Since(sent)
+
+		if !bytes.Equal(ping, pong) {
+			return errors.New("ping: echoed data differs from what was sent")
+		}
+
+		if i == 0 || roundTrip < min {
+			min = roundTrip
+		}
+
+		if roundTrip > max {
+			max = roundTrip
+		}
+
+		total += roundTrip
+	}
+
+	fmt.Fprintf(output, "OK   round trip min/avg/max %s/%s/%s (%d pings)\n",
+		min.Round(time.Microsecond),
+		(total / selfTestPings).Round(time.Microsecond),
+		max.Round(time.Microsecond),
+		selfTestPings)
+
+	return nil
+}
+
+// written and read back at the same time, so the pipes' buffers don't need to hold all of it
+func selfTestThroughput(conn net.Conn, output io.Writer) error {
+	payload := make([]byte, selfTestPayloadSize)
+	if _, err := rand.Read(payload); err != nil {
+		return err
+	}
+
+	started := time.Now()
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(payload)
+		writeErr <- err
+	}()
+
+	echoed := make([]byte, len(payload))
+
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		return fmt.Errorf("throughput: %s", err.Error())
+	}
+
+	if err := <-writeErr; err != nil {
+		return fmt.Errorf("throughput: %s", err.Error())
+	}
+
+	elapsed := time.Since(started)
+
+	if !bytes.Equal(payload, echoed) {
+		return errors.New("throughput: echoed data differs from what was sent")
+	}
+
+	fmt.Fprintf(output, "OK   %d bytes echoed intact in %s (%.1f MB/s each way)\n",
+		len(payload),
+		elapsed.Round(time.Millisecond),
+		float64(len(payload))/elapsed.Seconds()/1000/1000)
+
+	return nil
+}
+
+func serveEcho(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			_, _ = io.Copy(conn, conn)
+		}()
+	}
+}
+
+// what handleClient() does for a reverse forward, minus everything configurable
+func forwardToEcho(remoteListener net.Listener, echoAddr string) {
+	for {
+		client, err := remoteListener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func(client net.Conn) {
+			defer client.Close()
+
+			echo, err := net.Dial("tcp", echoAddr)
+			if err != nil {
+				return
+			}
+
+			_ = pipe(client, "tunnel", echo, "echo", defaultPipeBufferSize)
+		}(client)
+	}
+}
@@ -0,0 +1,186 @@
+package holepunch
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// systemd socket activation passes listeners as fds starting from 3
+// (see sd_listen_fds(3)) so that systemd, not us, binds local forwards' addresses
+const listenFdsStart = 3
+
+var activatedListeners = struct {
+	once      sync.Once
+	listeners []*activatedListener
+}{}
+
+// a listener passed by systemd. it's never closed, because it can't be re-opened: our
+// net.Listener for a forward is a lease, closing which (like on reconnect) only stops that
+// lease from accepting. meanwhile connections wait in the socket's backlog
+type activatedListener struct {
+	listener     net.Listener
+	accepted     chan acceptResult
+	acceptOnce   sync.Once
+	claimedMu    sync.Mutex
+	claimedByKey string // forward's listen endpoint, "" if not matched to a forward yet
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// read once, and ENV is unset so that hooks etc. don't think the listeners are theirs
+func listenersFromSystemd() []*activatedListener {
+	activatedListeners.once.Do(func() {
+		log := newLogger("socketActivation")
+
+		defer os.Unsetenv("LISTEN_PID")
+		defer os.Unsetenv("LISTEN_FDS")
+		defer os.Unsetenv("LISTEN_FDNAMES")
+
+		if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+			return // not for us
+		}
+
+		count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || count <= 0 {
+			return
+		}
+
+		for fd := listenFdsStart; fd < listenFdsStart+count; fd++ {
+			file := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+
+			// dups the fd (with close-on-exec)
+			listener, err := net.FileListener(file)
+			file.Close()
+			if err != nil {
+				log.Error(fmt.Sprintf("fd %d from systemd: %s", fd, err.Error()))
+				continue
+			}
+
+			log.Info(fmt.Sprintf("got listener %s from systemd", listener.Addr().String()))
+
+			activatedListeners.listeners = append(activatedListeners.listeners, &activatedListener{
+				listener: listener,
+				accepted: make(chan acceptResult),
+			})
+		}
+	})
+
+	return activatedListeners.listeners
+}
+
+// nil if systemd passed no matching listener, in which case we listen ourselves
+func activatedListenerFor(forward Forward) net.Listener {
+	key := forward.listenEndpoint().String()
+
+	for _, activated := range listenersFromSystemd() {
+		if !listenerMatchesEndpoint(activated.listener.Addr(), forward.Local) {
+			continue
+		}
+
+		activated.claimedMu.Lock()
+		claimable := activated.claimedByKey == "" || activated.claimedByKey == key
+		if claimable {
+			activated.claimedByKey = key
+		}
+		activated.claimedMu.Unlock()
+
+		if claimable {
+			return activated.lease()
+		}
+	}
+
+	return nil
+}
+
+// endpoint's host can be left empty (or be 0.0.0.0 / ::) for listening on all addresses, while
+// systemd's ListenStream=8080 listens on [::]:8080. hostnames are not resolved
+func listenerMatchesEndpoint(addr net.Addr, endpoint Endpoint) bool {
+	switch addr := addr.(type) {
+	case *net.UnixAddr:
+		return endpoint.isUnixSocket() && addr.Name == endpoint.Socket
+	case *net.TCPAddr:
+		if endpoint.isUnixSocket() || addr.Port != endpoint.Port {
+			return false
+		}
+
+		if endpoint.Host == "" {
+			return addr.IP.IsUnspecified()
+		}
+
+		endpointIp := net.ParseIP(endpoint.Host)
+
+		return endpointIp != nil && (endpointIp.Equal(addr.IP) || endpointIp.IsUnspecified() && addr.IP.IsUnspecified())
+	default:
+		return false
+	}
+}
+
+func (a *activatedListener) lease() net.Listener {
+	a.acceptOnce.Do(func() {
+		go func() {
+			for {
+				conn, err := a.listener.Accept()
+				a.accepted <- acceptResult{conn, err}
+			}
+		}()
+	})
+
+	return &activatedListenerLease{
+		activatedListener: a,
+		closed:            make(chan struct{}),
+	}
+}
+
+type activatedListenerLease struct {
+	*activatedListener
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *activatedListenerLease) Accept() (net.Conn, error) {
+	select {
+	case result := <-l.accepted:
+		return result.conn, result.err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// leaves the systemd-passed listener open
+func (l *activatedListenerLease) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+
+	return nil
+}
+
+func (l *activatedListenerLease) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// local addresses (after port_count expansion) to have systemd listen on, in systemd's
+// ListenStream= format
+func SystemdListenStreams(conf *Configuration) []string {
+	listenStreams := []string{}
+
+	for _, forward := range expandPortRanges(EnabledForwards(conf.Forwards)) {
+		if forward.Direction != forwardDirectionLocal && forward.Direction != forwardDirectionSocks {
+			continue
+		}
+
+		if !forward.Local.isUnixSocket() && forward.Local.Host == "" {
+			listenStreams = append(listenStreams, strconv.Itoa(forward.Local.Port)) // all addresses
+		} else {
+			listenStreams = append(listenStreams, forward.Local.address())
+		}
+	}
+
+	return listenStreams
+}
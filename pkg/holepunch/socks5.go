@@ -0,0 +1,203 @@
+package holepunch
+
+// minimal SOCKS5 (RFC 1928) server: no authentication, only the CONNECT command
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthNoAcceptable = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrTypeIpv4   = 0x01
+	socks5AddrTypeDomain = 0x03
+	socks5AddrTypeIpv6   = 0x04
+
+	socks5ReplySucceeded               = 0x00
+	socks5ReplyGeneralFailure          = 0x01
+	socks5ReplyNotAllowedByRuleset     = 0x02
+	socks5ReplyNetworkUnreachable      = 0x03
+	socks5ReplyHostUnreachable         = 0x04
+	socks5ReplyConnectionRefused       = 0x05
+	socks5ReplyCommandNotSupported     = 0x07
+	socks5ReplyAddressTypeNotSupported = 0x08
+)
+
+const socks5HandshakeTimeout = 30 * time.Second
+
+type socks5Dialer func(network string, addr string) (net.Conn, error)
+
+// performs SOCKS5 handshake with client, dials the requested destination and relays the
+// dial result to the client. on success client is ready to be piped to the returned conn.
+func socks5Connect(client net.Conn, dial socks5Dialer) (net.Conn, error) {
+	if err := client.SetDeadline(time.Now().Add(socks5HandshakeTimeout)); err != nil {
+		return nil, err
+	}
+
+	destination, err := socks5ReadConnectRequest(client)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: %s", err.Error())
+	}
+
+	remote, err := dial("tcp", destination)
+	if err != nil {
+		socks5Reply(client, socks5ReplyCodeForDialError(err))
+		return nil, fmt.Errorf("socks5: dial %s: %s", destination, err.Error())
+	}
+
+	if err := socks5Reply(client, socks5ReplySucceeded); err != nil {
+		remote.Close()
+		return nil, fmt.Errorf("socks5: %s", err.Error())
+	}
+
+	if err := client.SetDeadline(time.Time{}); err != nil {
+		remote.Close()
+		return nil, err
+	}
+
+	return remote, nil
+}
+
+// negotiates auth method and reads the request. returns destination as host:port
+func socks5ReadConnectRequest(client net.Conn) (string, error) {
+	// +-----+----------+----------+
+	// | VER | NMETHODS | METHODS  |
+	// +-----+----------+----------+
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(client, greeting); err != nil {
+		return "", err
+	}
+
+	if greeting[0] != socks5Version {
+		return "", fmt.Errorf("unsupported version %d", greeting[0])
+	}
+
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(client, methods); err != nil {
+		return "", err
+	}
+
+	if bytes.IndexByte(methods, socks5AuthNone) == -1 {
+		client.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return "", errors.New("client does not offer no-authentication method")
+	}
+
+	if _, err := client.Write([]byte{socks5Version, socks5AuthNone}); err != nil {
+		return "", err
+	}
+
+	// +-----+-----+-------+------+----------+----------+
+	// | VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+	// +-----+-----+-------+------+----------+----------+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(client, request); err != nil {
+		return "", err
+	}
+
+	if request[0] != socks5Version {
+		return "", fmt.Errorf("unsupported version %d", request[0])
+	}
+
+	if request[1] != socks5CmdConnect {
+		socks5Reply(client, socks5ReplyCommandNotSupported)
+		return "", fmt.Errorf("unsupported command %d", request[1])
+	}
+
+	var host string
+
+	switch request[3] {
+	case socks5AddrTypeIpv4, socks5AddrTypeIpv6:
+		ipLen := net.IPv4len
+		if request[3] == socks5AddrTypeIpv6 {
+			ipLen = net.IPv6len
+		}
+
+		ip := make([]byte, ipLen)
+		if _, err := io.ReadFull(client, ip); err != nil {
+			return "", err
+		}
+
+		host = net.IP(ip).String()
+	case socks5AddrTypeDomain:
+		domainLen := make([]byte, 1)
+		if _, err := io.ReadFull(client, domainLen); err != nil {
+			return "", err
+		}
+
+		domain := make([]byte, domainLen[0])
+		if _, err := io.ReadFull(client, domain); err != nil {
+			return "", err
+		}
+
+		host = string(domain)
+	default:
+		socks5Reply(client, socks5ReplyAddressTypeNotSupported)
+		return "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(client, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func socks5Reply(client net.Conn, replyCode byte) error {
+	// we don't know the address the SSH server bound for us, so reply with 0.0.0.0:0
+	// (clients generally don't care)
+	_, err := client.Write([]byte{
+		socks5Version,
+		replyCode,
+		0x00, // RSV
+		socks5AddrTypeIpv4,
+		0, 0, 0, 0, // BND.ADDR
+		0, 0, // BND.PORT
+	})
+	return err
+}
+
+// SSH server reports dial failures as channel open rejections. OpenSSH puts strerror() in
+// the message, which we can use for a more specific reply
+func socks5ReplyCodeForDialError(err error) byte {
+	if err == errDestinationNotAllowed {
+		return socks5ReplyNotAllowedByRuleset
+	}
+
+	openErr, is := err.(*ssh.OpenChannelError)
+	if !is {
+		return socks5ReplyGeneralFailure
+	}
+
+	switch openErr.Reason {
+	case ssh.Prohibited:
+		return socks5ReplyNotAllowedByRuleset
+	case ssh.ConnectionFailed:
+		msg := strings.ToLower(openErr.Message)
+
+		switch {
+		case strings.Contains(msg, "refused"):
+			return socks5ReplyConnectionRefused
+		case strings.Contains(msg, "network is unreachable"):
+			return socks5ReplyNetworkUnreachable
+		default:
+			return socks5ReplyHostUnreachable
+		}
+	default:
+		return socks5ReplyGeneralFailure
+	}
+}
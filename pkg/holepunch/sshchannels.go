@@ -0,0 +1,54 @@
+package holepunch
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// semaphore for SshServer.MaxChannels, for one SSH connection. each forwarded connection uses
+// one channel. nil = unlimited
+type sshChannelSlots chan struct{}
+
+func newSshChannelSlots(maxChannels int) sshChannelSlots {
+	if maxChannels == 0 {
+		return nil
+	}
+
+	return make(sshChannelSlots, maxChannels)
+}
+
+// queues instead of rejecting, since being over the cap is about load, not about a
+// misbehaving client. returns false if ctx was cancelled while queueing
+func (s sshChannelSlots) acquire(ctx context.Context, client net.Conn, forward Forward) bool {
+	if s == nil {
+		return true
+	}
+
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+	}
+
+	metrics.sshChannelWaits.Inc()
+
+	newLogger("acquireSshChannel").Warn(fmt.Sprintf(
+		"max_channels (%d) reached; %s for %s waits for a channel",
+		cap(s),
+		client.RemoteAddr(),
+		forward.listenEndpoint().String()))
+
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s sshChannelSlots) release() {
+	if s != nil {
+		<-s
+	}
+}
@@ -0,0 +1,153 @@
+package holepunch
+
+// --debug traces the SSH conversation: which auth methods and keys we offer and which the
+// server accepts, the host key it presents, and global requests in both directions. the
+// library only reports "handshake failed", which usually isn't enough to fix anything
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strings"
+)
+
+// set once at startup from --debug (which also implies --log-level=debug)
+var sshTraceEnabled = false
+
+// traces are logged at debug level, so that needs to be enabled too
+func SetSshTrace(enabled bool) {
+	sshTraceEnabled = enabled
+}
+
+var sshTraceLog = newLogger("sshTrace")
+
+func sshTrace(msg string) {
+	if !sshTraceEnabled {
+		return
+	}
+
+	sshTraceLog.Debug(msg)
+}
+
+func describePublicKey(key ssh.PublicKey) string {
+	return key.Type() + " " + ssh.FingerprintSHA256(key)
+}
+
+// ClientConfig's callbacks are where the library lets us see the handshake progress
+type sshHandshakeTrace struct {
+	addr              string
+	hostKeyVerifyDone bool
+	hostKeyErr        error
+}
+
+func traceClientConfig(addr string, config *ssh.ClientConfig) (*ssh.ClientConfig, *sshHandshakeTrace) {
+	trace := &sshHandshakeTrace{addr: addr}
+
+	traced := *config
+	traced.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		sshTrace(fmt.Sprintf("%s: server presented host key %s", addr, describePublicKey(key)))
+
+		err := config.HostKeyCallback(hostname, remote, key)
+
+		trace.hostKeyVerifyDone = true
+		trace.hostKeyErr = err
+
+		if err != nil {
+			sshTrace(fmt.Sprintf("%s: host key rejected: %s", addr, err.Error()))
+		} else {
+			sshTrace(fmt.Sprintf("%s: host key accepted", addr))
+		}
+
+		return err
+	}
+	traced.BannerCallback = func(message string) error {
+		sshTrace(fmt.Sprintf("%s: server banner: %s", addr, strings.TrimSpace(message)))
+		return nil
+	}
+
+	return &traced, trace
+}
+
+// tell at which stage the handshake failed, and what the server offered if it was key exchange
+func (s *sshHandshakeTrace) failed(serverKexInit *kexInitMsg, ours ssh.Config, err error) {
+	switch {
+	case serverKexInit == nil:
+		sshTrace(fmt.Sprintf("%s: failed before key exchange (not an SSH server, or connection dropped): %s", s.addr, err.Error()))
+	case !s.hostKeyVerifyDone:
+		ours.SetDefaults()
+
+		sshTrace(fmt.Sprintf("%s: key exchange failed: %s", s.addr, err.Error()))
+		sshTrace(fmt.Sprintf("%s: kex ours: %s; server: %s", s.addr, strings.Join(ours.KeyExchanges, ","), strings.Join(serverKexInit.KexAlgos, ",")))
+		sshTrace(fmt.Sprintf("%s: ciphers ours: %s; server: %s", s.addr, strings.Join(ours.Ciphers, ","), strings.Join(serverKexInit.CiphersClientServer, ",")))
+		sshTrace(fmt.Sprintf("%s: MACs ours: %s; server: %s", s.addr, strings.Join(ours.MACs, ","), strings.Join(serverKexInit.MACsClientServer, ",")))
+		sshTrace(fmt.Sprintf("%s: server host key algorithms: %s", s.addr, strings.Join(serverKexInit.ServerHostKeyAlgos, ",")))
+	case s.hostKeyErr != nil:
+		sshTrace(fmt.Sprintf("%s: failed at host key verification", s.addr))
+	default:
+		sshTrace(fmt.Sprintf("%s: authentication failed: %s", s.addr, err.Error()))
+	}
+}
+
+// the library offers each key (without signing) and signs only with the one the server
+// says it would accept, so a signature request means the key was accepted
+func traceSigners(signers []ssh.Signer) []ssh.Signer {
+	traced := []ssh.Signer{}
+
+	for _, signer := range signers {
+		sshTrace(fmt.Sprintf("publickey: offering %s", describePublicKey(signer.PublicKey())))
+
+		tracing := &tracingSigner{signer}
+
+		// RSA keys must remain AlgorithmSigners, or only SHA-1 "ssh-rsa" would be used
+		if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok {
+			traced = append(traced, &tracingAlgorithmSigner{tracing, algorithmSigner})
+		} else {
+			traced = append(traced, tracing)
+		}
+	}
+
+	return traced
+}
+
+type tracingSigner struct {
+	ssh.Signer
+}
+
+func (t *tracingSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	sshTrace(fmt.Sprintf("publickey: server accepts %s, signing", describePublicKey(t.PublicKey())))
+
+	return t.Signer.Sign(rand, data)
+}
+
+type tracingAlgorithmSigner struct {
+	*tracingSigner
+	algorithmSigner ssh.AlgorithmSigner
+}
+
+func (t *tracingAlgorithmSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	sshTrace(fmt.Sprintf(
+		"publickey: server accepts %s, signing with %s",
+		describePublicKey(t.PublicKey()),
+		algorithm))
+
+	return t.algorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+// server-initiated global requests (like OpenSSH's hostkeys-00@openssh.com). the library
+// rejects them all, we only log them on the way
+func traceGlobalRequests(addr string, reqs <-chan *ssh.Request) <-chan *ssh.Request {
+	traced := make(chan *ssh.Request)
+
+	go func() {
+		defer close(traced)
+
+		for req := range reqs {
+			sshTrace(fmt.Sprintf("%s: global request from server: %s (want reply: %v)", addr, req.Type, req.WantReply))
+
+			traced <- req
+		}
+	}()
+
+	return traced
+}
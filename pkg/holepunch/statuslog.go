@@ -0,0 +1,66 @@
+package holepunch
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// lightweight observability for when there's no Prometheus: one line for the tunnel and
+// one for each forward
+func logStatusPeriodically(ctx context.Context, state *tunnelState, interval time.Duration) {
+	log := newLogger("status")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	_, previousBytes := state.counters()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		uptime, connectedFor := state.uptimes()
+		reconnects, bytesTransferred := state.counters()
+
+		log.Info(fmt.Sprintf(
+			"up %s, connected for %s, %d reconnect(s)",
+			uptime.Round(time.Second),
+			connectedFor.Round(time.Second),
+			reconnects))
+
+		for _, forward := range state.snapshot().Forwards {
+			log.Info(fmt.Sprintf(
+				"%s: %d active, %d total connection(s), %s transferred in last %s",
+				forward.Forward,
+				forward.ActiveConnections,
+				forward.TotalConnections,
+				formatBytes(bytesTransferred[forward.Forward]-previousBytes[forward.Forward]),
+				interval))
+		}
+
+		previousBytes = bytesTransferred
+	}
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	value := float64(bytes) / unit
+	for _, suffix := range []string{"KB", "MB", "GB"} {
+		if value < unit {
+			return fmt.Sprintf("%.1f %s", value, suffix)
+		}
+
+		value /= unit
+	}
+
+	return fmt.Sprintf("%.1f TB", value)
+}
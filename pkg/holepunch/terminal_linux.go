@@ -0,0 +1,41 @@
+//go:build linux
+// +build linux
+
+package holepunch
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+func stdinIsTerminal() bool {
+	_, err := unix.IoctlGetTermios(int(os.Stdin.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// like for passwords: what's typed isn't shown
+func readLineFromStdinWithoutEcho() (string, error) {
+	fd := int(os.Stdin.Fd())
+
+	original, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return "", err
+	}
+
+	noEcho := *original
+	noEcho.Lflag &^= unix.ECHO
+
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &noEcho); err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = unix.IoctlSetTermios(fd, unix.TCSETS, original)
+	}()
+
+	line, err := readLineFromStdin()
+
+	fmt.Fprintln(os.Stderr) // the Enter wasn't echoed either
+
+	return line, err
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package holepunch
+
+import (
+	"errors"
+)
+
+// prompting is only supported on Linux. elsewhere keyboard-interactive needs
+// keyboard_interactive_responses
+func stdinIsTerminal() bool {
+	return false
+}
+
+func readLineFromStdinWithoutEcho() (string, error) {
+	return "", errors.New("reading from terminal not supported on this platform")
+}
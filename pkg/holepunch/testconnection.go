@@ -0,0 +1,72 @@
+package holepunch
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// connects to each server and checks that remote ports of reverse forwards can be bound.
+// details are written to output
+func TestConnection(conf *Configuration, output io.Writer) error {
+	failedServers := 0
+
+	for _, server := range conf.SshServers {
+		if err := testConnectionToServer(server, expandPortRanges(EnabledForwards(conf.Forwards)), output); err != nil {
+			failedServers++
+			fmt.Fprintf(output, "FAIL %s: %s\n", server.Address, err.Error())
+		}
+	}
+
+	if failedServers > 0 {
+		return fmt.Errorf("%d/%d server(s) failed", failedServers, len(conf.SshServers))
+	}
+
+	return nil
+}
+
+func testConnectionToServer(server SshServer, forwards []Forward, output io.Writer) error {
+	resolved, err := resolveSshServer(server)
+	if err != nil {
+		return err
+	}
+
+	sshClient, handshake, err := connectSsh(context.Background(), resolved)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+
+	fmt.Fprintf(output, "connected to %s\n", server.Address)
+	fmt.Fprintf(output, "server version: %s\n", handshake.serverVersion)
+	fmt.Fprintf(output, "host key:       %s\n", handshake.hostKey)
+	fmt.Fprintf(output, "key exchange:   %s\n", handshake.keyExchange)
+	fmt.Fprintf(output, "cipher:         %s (to server), %s (from server)\n", handshake.cipherClientToServer, handshake.cipherServerToClient)
+	fmt.Fprintf(output, "MAC:            %s (to server), %s (from server)\n", handshake.macClientToServer, handshake.macServerToClient)
+
+	bindFailures := 0
+
+	for _, forward := range forwards {
+		if forward.Direction != forwardDirectionReverse {
+			fmt.Fprintf(output, "SKIP %s (%s forward, nothing to bind remotely)\n", forward.Remote.String(), forward.Direction)
+			continue
+		}
+
+		listener, err := sshClient.Listen(forward.Remote.network(), forward.Remote.address())
+		if err != nil {
+			bindFailures++
+			fmt.Fprintf(output, "FAIL %s: %s\n", forward.Remote.String(), err.Error())
+			continue
+		}
+
+		listener.Close()
+
+		fmt.Fprintf(output, "OK   %s\n", forward.Remote.String())
+	}
+
+	if bindFailures > 0 {
+		return fmt.Errorf("%d remote port(s) could not be bound", bindFailures)
+	}
+
+	return nil
+}
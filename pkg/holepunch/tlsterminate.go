@@ -0,0 +1,128 @@
+package holepunch
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+// certificates for terminating TLS of a reverse forward. files are re-read when they
+// change, so renewed certificates (like from Let's Encrypt) are picked up without a restart
+type certificateStore struct {
+	pairs        []TlsCertificate // first is the default if SNI matches none
+	mu           sync.Mutex
+	certificates []tls.Certificate
+	loadedFrom   string // modification times of the files, to detect changes
+}
+
+func newCertificateStore(pairs []TlsCertificate) (*certificateStore, error) {
+	store := &certificateStore{pairs: pairs}
+
+	if _, err := store.current(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// if the files changed but can't be loaded (say, cert renewed but key not yet), keeps
+// using the previous ones
+func (c *certificateStore) current() ([]tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	modTimes, err := c.modTimes()
+	if err == nil && modTimes == c.loadedFrom {
+		return c.certificates, nil
+	}
+
+	if err == nil {
+		var certificates []tls.Certificate
+		certificates, err = c.load()
+		if err == nil {
+			c.certificates = certificates
+			c.loadedFrom = modTimes
+			return certificates, nil
+		}
+	}
+
+	if c.certificates == nil {
+		return nil, err
+	}
+
+	newLogger("certificateStore").Warn(fmt.Sprintf("using previously loaded certificates: %s", err.Error()))
+
+	return c.certificates, nil
+}
+
+func (c *certificateStore) load() ([]tls.Certificate, error) {
+	certificates := []tls.Certificate{}
+
+	for _, pair := range c.pairs {
+		certificate, err := tls.LoadX509KeyPair(pair.CertPath, pair.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load TLS certificate %s: %s", pair.CertPath, err.Error())
+		}
+
+		certificates = append(certificates, certificate)
+	}
+
+	return certificates, nil
+}
+
+func (c *certificateStore) modTimes() (string, error) {
+	modTimes := ""
+
+	for _, pair := range c.pairs {
+		for _, path := range []string{pair.CertPath, pair.KeyPath} {
+			info, err := os.Stat(path)
+			if err != nil {
+				return "", err
+			}
+
+			modTimes += info.ModTime().String() + ";"
+		}
+	}
+
+	return modTimes, nil
+}
+
+// certificate by SNI (same as what crypto/tls does for Config.Certificates)
+func (c *certificateStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificates, err := c.current()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range certificates {
+		if hello.SupportsCertificate(&certificates[i]) == nil {
+			return &certificates[i], nil
+		}
+	}
+
+	return &certificates[0], nil
+}
+
+// client speaks TLS to us, and the local service gets plaintext
+func terminateTls(ctx context.Context, client net.Conn, store *certificateStore) (net.Conn, error) {
+	tlsClient := tls.Server(client, &tls.Config{
+		GetCertificate: store.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	})
+
+	// SSH channels don't support deadlines
+	handshakeCtx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+
+	if err := tlsClient.HandshakeContext(handshakeCtx); err != nil {
+		return nil, err
+	}
+
+	return tlsClient, nil
+}
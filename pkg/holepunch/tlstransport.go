@@ -0,0 +1,80 @@
+package holepunch
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strings"
+)
+
+const tlsAddressPrefix = "tls://"
+
+func isTlsAddress(address string) bool {
+	return strings.HasPrefix(address, tlsAddressPrefix)
+}
+
+// server.Address looks like "tls://example.com:443": SSH inside plain TLS (no websocket
+// framing), like behind stunnel or a TLS-terminating load balancer. server's TLS certificate
+// is verified (against ca_cert_path or system CAs) in addition to the SSH host key
+func connectSshTls(
+	ctx context.Context,
+	server SshServer,
+	sshConfig *ssh.ClientConfig,
+) (*ssh.Client, *handshakeDetails, error) {
+	log := newLogger("connectSshTls")
+
+	addr := strings.TrimPrefix(server.Address, tlsAddressPrefix)
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsConfig, err := serverTlsConfig(server)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig.ServerName = host // SNI, and the name the certificate must be valid for
+
+	conn, err := dialSshServer(ctx, server, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	handshakeCtx, cancel := context.WithTimeout(ctx, server.ConnectTimeout.Duration)
+	defer cancel()
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("TLS handshake: %s", err.Error())
+	}
+
+	log.Debug(fmt.Sprintf(
+		"TLS %s established with %s",
+		tlsVersionName(tlsConn.ConnectionState().Version),
+		addr))
+
+	// host key verification uses the host:port without scheme
+	return sshClientForConn(tlsConn, addr, sshConfig)
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	default:
+		return fmt.Sprintf("0x%04x", version)
+	}
+}
@@ -0,0 +1,171 @@
+package holepunch
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// returns all problems found instead of stopping at first one
+func ValidateConfig(conf *Configuration) []error {
+	problems := []error{}
+
+	for i, server := range conf.SshServers {
+		for _, problem := range validateSshServer(server) {
+			problems = append(problems, fmt.Errorf("ssh_servers[%d]: %s", i, problem.Error()))
+		}
+	}
+
+	for i, forward := range conf.Forwards {
+		if err := validateEndpoint(forward.Local, false); err != nil {
+			problems = append(problems, fmt.Errorf("forwards[%d].local: %s", i, err.Error()))
+		}
+
+		for j, backend := range forward.LocalBackends {
+			if err := validateEndpoint(backend, false); err != nil {
+				problems = append(problems, fmt.Errorf("forwards[%d].local_backends[%d]: %s", i, j, err.Error()))
+			}
+		}
+
+		if forward.DSCP != 0 && !dscpSupported {
+			problems = append(problems, fmt.Errorf("forwards[%d]: dscp is not supported on this OS (ignored)", i))
+		}
+
+		if forward.Direction == forwardDirectionSocks {
+			continue // client chooses the remote
+		}
+
+		// server can assign port for reverse forwards
+		remotePortZeroAllowed := forward.Direction == forwardDirectionReverse
+
+		if err := validateEndpoint(forward.Remote, remotePortZeroAllowed); err != nil {
+			problems = append(problems, fmt.Errorf("forwards[%d].remote: %s", i, err.Error()))
+		}
+
+		if forward.Direction == forwardDirectionReverse {
+			if err := validateRemoteBindAddress(forward.Remote); err != nil {
+				problems = append(problems, fmt.Errorf("forwards[%d].remote: %s", i, err.Error()))
+			}
+		}
+	}
+
+	if len(EnabledForwards(conf.Forwards)) == 0 && !conf.AllowNoForwards {
+		problems = append(problems, errNoForwards)
+	}
+
+	return problems
+}
+
+func validateSshServer(server SshServer) []error {
+	problems := []error{}
+
+	if server.Address == "" {
+		problems = append(problems, errors.New("address not set"))
+	} else if !isWebsocketAddress(server.Address) {
+		if _, _, err := net.SplitHostPort(strings.TrimPrefix(server.Address, tlsAddressPrefix)); err != nil {
+			problems = append(problems, fmt.Errorf(
+				"address %s: expecting host:port (IPv6 addresses in brackets, like [2001:db8::1]:22)",
+				server.Address))
+		}
+	}
+
+	if server.Username == "" {
+		problems = append(problems, errors.New("username not set"))
+	}
+
+	if hasPrivateKeys(server) {
+		if keyFileToGenerate(server) != "" {
+			// will be generated on connect
+		} else if _, err := privateKeySigners(server); err != nil {
+			problems = append(problems, err)
+		}
+	} else if !server.UseAgent && !usesKeyboardInteractive(server) {
+		problems = append(problems, errNoAuthConfigured)
+	}
+
+	if server.WebsocketAuthTokenFile != "" {
+		if _, err := websocketHeaders(server); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	if _, err := hostKeyCallbackFromConfig(server); err != nil {
+		problems = append(problems, err)
+	}
+
+	if server.JumpHost != nil {
+		for _, problem := range validateSshServer(*server.JumpHost) {
+			problems = append(problems, fmt.Errorf("jump_host: %s", problem.Error()))
+		}
+	}
+
+	return problems
+}
+
+func validateEndpoint(endpoint Endpoint, portZeroAllowed bool) error {
+	if endpoint.isUnixSocket() {
+		if endpoint.Host != "" || endpoint.Port != 0 {
+			return errors.New("specify either socket or host+port, not both")
+		}
+
+		return nil
+	}
+
+	if _, _, err := net.SplitHostPort(endpoint.address()); err != nil {
+		return err
+	}
+
+	if endpoint.Port < 0 || endpoint.Port > 65535 || (endpoint.Port == 0 && !portZeroAllowed) {
+		return fmt.Errorf("invalid port %d", endpoint.Port)
+	}
+
+	return nil
+}
+
+// for local and socks forwards, whose Local is listened on. a hostname would be resolved to
+// just one of its addresses, so only "localhost" is accepted
+func validateLocalBindAddress(endpoint Endpoint) error {
+	if endpoint.isUnixSocket() {
+		return nil
+	}
+
+	if endpoint.Port <= 0 || endpoint.Port > 65535 {
+		return fmt.Errorf("invalid port %d to listen on", endpoint.Port)
+	}
+
+	if endpoint.Host != "" && endpoint.Host != "localhost" && net.ParseIP(endpoint.Host) == nil {
+		return fmt.Errorf(
+			"host must be an IP address to listen on (like 127.0.0.1, or 0.0.0.0 for all interfaces), got '%s'",
+			endpoint.Host)
+	}
+
+	return nil
+}
+
+// listening on anything else makes the tunnel entrance reachable from other machines
+func isLoopbackBindAddress(endpoint Endpoint) bool {
+	if endpoint.isUnixSocket() || endpoint.Host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(endpoint.Host)
+
+	return ip != nil && ip.IsLoopback() // "" = all interfaces
+}
+
+// the SSH library resolves hostnames on our side, which rarely is what the server would think
+// they mean. binding to non-loopback addresses needs "GatewayPorts clientspecified" in sshd
+func validateRemoteBindAddress(endpoint Endpoint) error {
+	if endpoint.isUnixSocket() {
+		return nil
+	}
+
+	if net.ParseIP(endpoint.Host) == nil {
+		return fmt.Errorf(
+			"host must be an IP address to bind to on the server (like 127.0.0.1 or 0.0.0.0), got '%s'",
+			endpoint.Host)
+	}
+
+	return nil
+}
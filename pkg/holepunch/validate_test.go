@@ -0,0 +1,171 @@
+package holepunch
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestValidateSshServerAddress(t *testing.T) {
+	for _, tc := range []struct {
+		address string
+		valid   bool
+	}{
+		{"ssh.example.com:22", true},
+		{"192.0.2.1:22", true},
+		{"[2001:db8::1]:22", true},
+		{"tls://[2001:db8::1]:443", true},
+		{"wss://[2001:db8::1]/_ssh", true},
+		{"ssh.example.com", false},
+		{"2001:db8::1:22", false}, // ambiguous without brackets
+		{"2001:db8::1", false},
+	} {
+		addressProblem := ""
+		for _, problem := range validateSshServer(SshServer{Address: tc.address}) {
+			if strings.Contains(problem.Error(), "expecting host:port") {
+				addressProblem = problem.Error()
+			}
+		}
+
+		if tc.valid && addressProblem != "" {
+			t.Errorf("%s: unexpected error: %s", tc.address, addressProblem)
+		}
+
+		if !tc.valid && addressProblem == "" {
+			t.Errorf("%s: expected error", tc.address)
+		}
+	}
+}
+
+func TestValidateEndpointIpv6(t *testing.T) {
+	if err := validateEndpoint(Endpoint{Host: "2001:db8::1", Port: 22}, false); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+
+	if err := validateEndpoint(Endpoint{Host: "::1", Port: 0}, false); err == nil {
+		t.Error("expected error for port 0")
+	}
+}
+
+func TestValidateLocalBindAddress(t *testing.T) {
+	for _, tc := range []struct {
+		host     string
+		valid    bool
+		loopback bool
+	}{
+		{"127.0.0.1", true, true},
+		{"::1", true, true},
+		{"localhost", true, true},
+		{"0.0.0.0", true, false},
+		{"", true, false}, // all interfaces
+		{"192.0.2.10", true, false},
+		{"example.com", false, false},
+	} {
+		endpoint := Endpoint{Host: tc.host, Port: 8080}
+
+		if err := validateLocalBindAddress(endpoint); (err == nil) != tc.valid {
+			t.Errorf("'%s': validateLocalBindAddress() = %v; expected valid=%v", tc.host, err, tc.valid)
+		}
+
+		if loopback := isLoopbackBindAddress(endpoint); loopback != tc.loopback {
+			t.Errorf("'%s': isLoopbackBindAddress() = %v; expected %v", tc.host, loopback, tc.loopback)
+		}
+	}
+
+	if err := validateLocalBindAddress(Endpoint{Host: "127.0.0.1", Port: 0}); err == nil {
+		t.Error("expected error for port 0")
+	}
+}
+
+func TestListenForLocalForward(t *testing.T) {
+	addr, logged := listenForLocalForwardAndDial(t, "127.0.0.1", "127.0.0.1")
+
+	if !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("listening on %s", addr)
+	}
+
+	if strings.Contains(logged, "not a loopback address") {
+		t.Errorf("unexpected warning: %s", logged)
+	}
+}
+
+func TestListenForLocalForwardOnInterfaceAddress(t *testing.T) {
+	ip := firstNonLoopbackUnicastIp(t)
+	if ip == nil {
+		t.Skip("no non-loopback unicast address")
+	}
+
+	addr, logged := listenForLocalForwardAndDial(t, ip.String(), ip.String())
+
+	endpoint := Endpoint{Host: ip.String(), Port: 0}
+
+	if !addr.IP.Equal(ip) {
+		t.Errorf("listening on %s; expected %s", addr, ip)
+	}
+
+	if !strings.Contains(logged, endpoint.String()+" is not a loopback address") {
+		t.Errorf("expected non-loopback warning; got: %s", logged)
+	}
+}
+
+func TestListenForLocalForwardOnAllInterfaces(t *testing.T) {
+	addr, logged := listenForLocalForwardAndDial(t, "0.0.0.0", "127.0.0.1")
+
+	if !addr.IP.IsUnspecified() {
+		t.Errorf("listening on %s", addr)
+	}
+
+	if !strings.Contains(logged, "0.0.0.0:0 is not a loopback address") {
+		t.Errorf("expected non-loopback warning; got: %s", logged)
+	}
+}
+
+// returns the listener's address and what was logged while starting to listen
+func listenForLocalForwardAndDial(t *testing.T, host string, dialHost string) (*net.TCPAddr, string) {
+	t.Helper()
+
+	logged := &bytes.Buffer{}
+	log.SetOutput(logged)
+	defer log.SetOutput(os.Stderr)
+
+	listener, err := listenForForward(Forward{
+		Direction: forwardDirectionLocal,
+		Local:     Endpoint{Host: host, Port: 0},
+	}, nil) // local forwards listen without the SSH connection
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	if addr.Port == 0 {
+		t.Errorf("listening on %s", addr)
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(dialHost, strconv.Itoa(addr.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	return addr, logged.String()
+}
+
+func firstNonLoopbackUnicastIp(t *testing.T) net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+			return ipNet.IP
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package holepunch
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/function61/holepunch-server/pkg/wsconnadapter"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// server.Address looks like "ws://example.com/_ssh"
+func connectSshWebsocket(
+	ctx context.Context,
+	server SshServer,
+	sshConfig *ssh.ClientConfig,
+) (*ssh.Client, *handshakeDetails, error) {
+	addr := server.Address
+
+	dialer, err := websocketDialer(server)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	headers, err := websocketHeaders(server)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wsConn, _, err := dialer.DialContext(ctx, addr, headers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// server not agreeing usually means the endpoint is not what we think it is
+	if server.WebsocketSubprotocol != "" && wsConn.Subprotocol() != server.WebsocketSubprotocol {
+		wsConn.Close()
+
+		return nil, nil, fmt.Errorf(
+			"websocket sub-protocol %s requested, but server negotiated '%s'",
+			server.WebsocketSubprotocol,
+			wsConn.Subprotocol())
+	}
+
+	// even though we have a solid connection already, NewClientConn() requires address
+	// because it's used for host key verification, which needs it in host:port form
+	wsUrl, err := url.Parse(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// backends behind a shared ingress have host keys of their own
+	if server.WebsocketHost != "" {
+		wsUrl.Host = server.WebsocketHost
+	}
+
+	return sshClientForConn(wsconnadapter.New(wsConn), websocketHostPort(wsUrl), sshConfig)
+}
+
+func websocketDialer(server SshServer) (*websocket.Dialer, error) {
+	tlsConfig, err := serverTlsConfig(server)
+	if err != nil {
+		return nil, err
+	}
+
+	if server.WebsocketHost != "" {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+
+		// also the name the certificate must be valid for
+		tlsConfig.ServerName = hostWithoutPort(server.WebsocketHost)
+	}
+
+	dialer := *websocket.DefaultDialer // inherit proxy from environment
+	dialer.HandshakeTimeout = server.ConnectTimeout.Duration
+	dialer.TLSClientConfig = tlsConfig
+	if server.WebsocketSubprotocol != "" {
+		dialer.Subprotocols = []string{server.WebsocketSubprotocol}
+	}
+	if server.ProxyURL != "" {
+		proxyUrl, err := parseProxyUrl(server.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+
+		dialer.Proxy = http.ProxyURL(proxyUrl)
+	}
+	// for wss:// UnderlyingConn() is the TLS conn, so keepalive can't be enabled after the fact
+	dialer.NetDialContext = (&net.Dialer{
+		Timeout:       server.ConnectTimeout.Duration,
+		KeepAlive:     dialerKeepAlive(server),
+		FallbackDelay: happyEyeballsFallbackDelay,
+	}).DialContext
+
+	return &dialer, nil
+}
+
+// client certificate (mutual TLS) and CA for verifying the server's certificate, for wss://
+// and tls:// addresses. these are separate from SSH host key verification. returns nil if
+// using defaults. read on each connect, so rotated certificates are picked up on reconnect.
+func serverTlsConfig(server SshServer) (*tls.Config, error) {
+	if server.ClientCertPath == "" && server.ClientKeyPath == "" && server.CaCertPath == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if server.ClientCertPath != "" || server.ClientKeyPath != "" {
+		clientCert, err := tls.LoadX509KeyPair(server.ClientCertPath, server.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load TLS client certificate: %s", err.Error())
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	if server.CaCertPath != "" {
+		caCertPem, err := ioutil.ReadFile(server.CaCertPath)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read CA certificate file %s", server.CaCertPath)
+		}
+
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caCertPem) {
+			return nil, fmt.Errorf("No certificates found from CA certificate file %s", server.CaCertPath)
+		}
+
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	return tlsConfig, nil
+}
+
+// values can refer to ENV variables (like "Bearer ${API_TOKEN}") so secrets need not be in
+// the config file
+func websocketHeaders(server SshServer) (http.Header, error) {
+	headers := http.Header{}
+
+	for key, value := range server.WebsocketHeaders {
+		headers.Set(key, value) // ENV expanded by expandEnvInConfig()
+	}
+
+	if server.WebsocketAuthTokenFile != "" {
+		token, err := ioutil.ReadFile(server.WebsocketAuthTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read websocket_auth_token_file: %s", err.Error())
+		}
+
+		// token files usually end with a newline
+		trimmed := strings.TrimSpace(string(token))
+		if trimmed == "" {
+			return nil, fmt.Errorf("websocket_auth_token_file %s is empty", server.WebsocketAuthTokenFile)
+		}
+
+		headers.Set("Authorization", "Bearer "+trimmed)
+	}
+
+	// the websocket library uses this as the request's Host
+	if server.WebsocketHost != "" {
+		headers.Set("Host", server.WebsocketHost)
+	}
+
+	return headers, nil
+}
+
+// "example.com:8443" => "example.com"
+func hostWithoutPort(hostMaybeWithPort string) string {
+	host, _, err := net.SplitHostPort(hostMaybeWithPort)
+	if err != nil { // no port
+		return hostMaybeWithPort
+	}
+
+	return host
+}
+
+// "ws://example.com/_ssh" => "example.com:80"
+func websocketHostPort(wsUrl *url.URL) string {
+	port := wsUrl.Port()
+	if port == "" {
+		if wsUrl.Scheme == "wss" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+
+	return net.JoinHostPort(wsUrl.Hostname(), port)
+}
@@ -0,0 +1,28 @@
+package holepunch
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestWebsocketHostPort(t *testing.T) {
+	for _, tc := range []struct {
+		wsUrl    string
+		expected string
+	}{
+		{"ws://example.com/_ssh", "example.com:80"},
+		{"wss://example.com/_ssh", "example.com:443"},
+		{"wss://example.com:8443/_ssh", "example.com:8443"},
+		{"wss://[2001:db8::1]/_ssh", "[2001:db8::1]:443"},
+		{"ws://[2001:db8::1]:8080/_ssh", "[2001:db8::1]:8080"},
+	} {
+		wsUrl, err := url.Parse(tc.wsUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hostPort := websocketHostPort(wsUrl); hostPort != tc.expected {
+			t.Errorf("%s: %s; expected %s", tc.wsUrl, hostPort, tc.expected)
+		}
+	}
+}